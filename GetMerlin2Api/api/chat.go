@@ -2,13 +2,23 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
@@ -17,17 +27,62 @@ type OpenAIRequest struct {
 	Messages []Message `json:"messages"`
 	Stream   bool      `json:"stream"`
 	Model    string    `json:"model"`
+	N        *int      `json:"n"` // 返回的choice数，每个choice对应一个独立的上游对话
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role    string         `json:"role"`
+	Content MessageContent `json:"content"`
+}
+
+// MessageContent 兼容字符串和 content-part 数组两种写法
+type MessageContent struct {
+	Text   string
+	Images []string // image_url 中的 data URL 或 http URL
+}
+
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	*c = MessageContent{}
+	if len(data) == 0 || data[0] != '[' {
+		if string(data) == "null" {
+			return nil
+		}
+		return json.Unmarshal(data, &c.Text)
+	}
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	var texts []string
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			texts = append(texts, p.Text)
+		case "image_url":
+			if p.ImageURL.URL != "" {
+				c.Images = append(c.Images, p.ImageURL.URL)
+			}
+		}
+	}
+	c.Text = strings.Join(texts, "\n")
+	return nil
+}
+
+type MerlinAttachment struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
 }
 
 type MerlinRequest struct {
-	Attachments []interface{} `json:"attachments"`
-	ChatId      string        `json:"chatId"`
-	Language    string        `json:"language"`
+	Attachments []MerlinAttachment `json:"attachments"`
+	ChatId      string             `json:"chatId"`
+	Language    string             `json:"language"`
 	Message     struct {
 		Content  string `json:"content"`
 		Context  string `json:"context"`
@@ -52,17 +107,21 @@ type MerlinResponse struct {
 }
 
 type OpenAIResponse struct {
-	Id      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Delta struct {
-			Content string `json:"content"`
-		} `json:"delta"`
-		Index        int    `json:"index"`
-		FinishReason string `json:"finish_reason"`
-	} `json:"choices"`
+	Id      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+}
+
+type ChunkChoice struct {
+	Delta struct {
+		Content string `json:"content"`
+	} `json:"delta"`
+	Index        int    `json:"index"`
+	FinishReason string `json:"finish_reason"`
+	// n > 1 时单个choice失败的原因，此时 finish_reason 为 error
+	Error *ErrorDetail `json:"error,omitempty"`
 }
 
 type TokenResponse struct {
@@ -76,7 +135,97 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
-func getToken() (string, error) {
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("invalid duration %s=%q, using %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		log.Printf("invalid integer %s=%q, using %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+// 上游超时设置，不设总超时，长回复只受流空闲超时约束
+var (
+	connectTimeout      = getEnvDuration("UPSTREAM_CONNECT_TIMEOUT", 10*time.Second)
+	tlsHandshakeTimeout = getEnvDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+	firstByteTimeout    = getEnvDuration("UPSTREAM_FIRST_BYTE_TIMEOUT", 60*time.Second)
+	streamIdleTimeout   = getEnvDuration("UPSTREAM_STREAM_IDLE_TIMEOUT", 120*time.Second)
+	idleConnTimeout     = getEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 90*time.Second)
+	maxIdleConnsPerHost = getEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 16)
+)
+
+// 每个上游各用一个共享连接池
+var (
+	tokenClient  = newUpstreamClient()
+	merlinClient = newUpstreamClient()
+)
+
+func newUpstreamClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: firstByteTimeout,
+		MaxIdleConns:          maxIdleConnsPerHost * 2,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+	}}
+}
+
+var errStreamIdle = errors.New("upstream stream idle timeout")
+
+// idleTimeoutBody 两次读取之间超过 streamIdleTimeout 即取消上游请求
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	start  time.Time // 上游请求发出的时间
+}
+
+func withIdleTimeout(ctx context.Context, cancel context.CancelCauseFunc, body io.ReadCloser, start time.Time) io.ReadCloser {
+	return &idleTimeoutBody{
+		start:      start,
+		ReadCloser: body,
+		ctx:        ctx,
+		cancel:     cancel,
+		timer:      time.AfterFunc(streamIdleTimeout, func() { cancel(errStreamIdle) }),
+	}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && errors.Is(context.Cause(b.ctx), errStreamIdle) {
+		return n, errStreamIdle
+	}
+	b.timer.Reset(streamIdleTimeout)
+	return n, err
+}
+
+// Close 关闭响应体并释放上游请求的上下文
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
+func getToken(ctx context.Context) (string, error) {
 	tokenReq := struct {
 		UUID string `json:"uuid"`
 	}{
@@ -84,15 +233,19 @@ func getToken() (string, error) {
 	}
 
 	tokenReqBody, _ := json.Marshal(tokenReq)
-	resp, err := http.Post(
-		"https://getmerlin-main-server.vercel.app/generate",
-		"application/json",
-		strings.NewReader(string(tokenReqBody)),
-	)
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://getmerlin-main-server.vercel.app/generate", strings.NewReader(string(tokenReqBody)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := tokenClient.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token server status=%d", resp.StatusCode)
+	}
 
 	var tokenResp TokenResponse
 	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
@@ -102,40 +255,565 @@ func getToken() (string, error) {
 	return tokenResp.IdToken, nil
 }
 
+// ---- Prometheus 指标（/metrics，文本格式，只依赖标准库）----
+
+// 延迟分桶：覆盖从几百毫秒的首字到数分钟的长回复
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// metricVec 一个指标族，typ 为 counter / gauge / histogram
+type metricVec struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64  // counter / gauge
+	counts []uint64 // histogram 各桶计数，非累计
+	sum    float64
+	count  uint64
+}
+
+var allMetrics []*metricVec
+
+func newMetric(typ, name, help string, buckets []float64, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: map[string]*metricSeries{}}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+var (
+	metricRequests = newMetric("counter", "merlin_requests_total",
+		"下游请求数", nil, "endpoint", "model", "status")
+	metricInFlight = newMetric("gauge", "merlin_requests_in_flight",
+		"正在处理的下游请求数", nil, "endpoint")
+	metricFirstToken = newMetric("histogram", "merlin_upstream_first_token_seconds",
+		"发出上游请求到收到第一段内容的耗时", latencyBuckets, "endpoint")
+	metricUpstreamDuration = newMetric("histogram", "merlin_upstream_duration_seconds",
+		"发出上游请求到上游流结束的总耗时", latencyBuckets, "endpoint")
+	metricStreamDuration = newMetric("histogram", "merlin_stream_duration_seconds",
+		"流式响应从收到请求到结束的时长", latencyBuckets, "endpoint", "model")
+	metricOutputChars = newMetric("counter", "merlin_output_characters_total",
+		"上游输出的字符数", nil, "endpoint", "model")
+	metricTokenFetches = newMetric("counter", "merlin_token_fetch_total",
+		"获取上游 token 的次数，result 为 success 或 failure", nil, "result")
+)
+
+func (m *metricVec) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: append([]string(nil), labels...), counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add 用于 counter 和 gauge
+func (m *metricVec) add(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value += v
+}
+
+func (m *metricVec) observe(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	for i, b := range m.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricVec) labelString(values []string, extra ...string) string {
+	var parts []string
+	for i, v := range values {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, m.labels[i], labelEscaper.Replace(v)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (m *metricVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelString(s.labels), strconv.FormatFloat(s.value, 'g', -1, 64))
+			continue
+		}
+		var cumulative uint64
+		for i, b := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s.labels, "le", strconv.FormatFloat(b, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelString(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelString(s.labels), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelString(s.labels), s.count)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range allMetrics {
+		m.writeTo(w)
+	}
+}
+
+// requestMetrics 请求级别的指标标签，由处理函数在解析请求后补全
+type requestMetrics struct {
+	endpoint string
+	model    string
+	stream   bool
+}
+
+type requestMetricsKey struct{}
+
+func metricsFor(r *http.Request) *requestMetrics {
+	if rm, ok := r.Context().Value(requestMetricsKey{}).(*requestMetrics); ok {
+		return rm
+	}
+	return &requestMetrics{}
+}
+
+// metricsEndpoint 按路由归类，避免 /hf/v1/responses/{id} 导致标签基数失控
+func metricsEndpoint(path string) string {
+	switch {
+	case path == "/hf/v1/chat/completions", path == "/metrics", path == "/healthz", path == "/readyz":
+		return path
+	case path == "/hf/v1/responses" || strings.HasPrefix(path, "/hf/v1/responses/"):
+		return "/hf/v1/responses"
+	default:
+		return "/"
+	}
+}
+
+// statusRecorder 记录状态码，保留 Flush 供流式响应使用
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func Handler(w http.ResponseWriter, r *http.Request) {
+	rm := &requestMetrics{endpoint: metricsEndpoint(r.URL.Path)}
+	r = r.WithContext(context.WithValue(r.Context(), requestMetricsKey{}, rm))
+	metricInFlight.add(1, rm.endpoint)
+	defer metricInFlight.add(-1, rm.endpoint)
+
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	route(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	metricRequests.add(1, rm.endpoint, rm.model, strconv.Itoa(rec.status))
+	if rm.stream {
+		metricStreamDuration.observe(time.Since(start).Seconds(), rm.endpoint, rm.model)
+	}
+}
+
+func route(w http.ResponseWriter, r *http.Request) {
+	// 健康检查供容器编排调用，不校验 AUTH_TOKEN
+	switch r.URL.Path {
+	case "/healthz":
+		handleHealthz(w, r)
+		return
+	case "/readyz":
+		handleReadyz(w, r)
+		return
+	}
+
 	authToken := r.Header.Get("Authorization")
 	envToken := getEnvOrDefault("AUTH_TOKEN", "")
 
 	if envToken != "" && authToken != "Bearer "+envToken {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, "authentication_error", "invalid_api_key", "", "Invalid API key")
 		return
 	}
 
-	if r.URL.Path != "/hf/v1/chat/completions" {
+	switch {
+	case r.URL.Path == "/metrics":
+		handleMetrics(w, r)
+	case r.URL.Path == "/hf/v1/chat/completions":
+		handleChatCompletions(w, r)
+	case r.URL.Path == "/hf/v1/responses" || strings.HasPrefix(r.URL.Path, "/hf/v1/responses/"):
+		handleResponses(w, r)
+	default:
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, `{"status":"GetMerlin2Api Service Running...","message":"MoLoveSze..."}`)
-		return
 	}
+}
+
+// maxChoices chat completions 中 n 的上限，每个choice并发调用一次上游
+var maxChoices = getEnvInt("MAX_CHOICES", 4)
 
+func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "", "Method not allowed")
 		return
 	}
 
 	var openAIReq OpenAIRequest
 	if err := json.NewDecoder(r.Body).Decode(&openAIReq); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "", "Invalid JSON body: "+err.Error())
+		return
+	}
+	if len(openAIReq.Messages) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "missing_required_parameter", "messages", "messages is required")
+		return
+	}
+	n := 1
+	if openAIReq.N != nil {
+		n = *openAIReq.N
+	}
+	if n < 1 || n > maxChoices {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid_value", "n", fmt.Sprintf("n must be between 1 and %d", maxChoices))
+		return
+	}
+	metricsFor(r).model = openAIReq.Model
+
+	// 每个choice使用独立的 chatId 和token
+	merlinReqs := make([]MerlinRequest, n)
+	for i := range merlinReqs {
+		merlinReq, err := newMerlinRequest(openAIReq.Messages, openAIReq.Model)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_content", "messages", err.Error())
+			return
+		}
+		merlinReqs[i] = merlinReq
+	}
+
+	resps, errs := openChoices(r, merlinReqs)
+	if clientGone(r) {
+		closeAll(resps)
+		return
+	}
+	defer closeAll(resps)
+	// 所有choice都失败时直接返回错误
+	if err := firstError(errs); err != nil {
+		writeStreamError(w, err)
+		return
+	}
+
+	if !openAIReq.Stream {
+		contents := make([]string, n)
+		var wg sync.WaitGroup
+		for i, resp := range resps {
+			if resp == nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var fullContent string
+				errs[i] = readMerlin(r, resp.Body, func(content string) {
+					if content != " " {
+						fullContent += content
+					}
+				})
+				contents[i] = fullContent
+			}()
+		}
+		wg.Wait()
+		if clientGone(r) {
+			logCanceled(r, "non-stream")
+			return
+		}
+		if err := firstError(errs); err != nil {
+			writeStreamError(w, err)
+			return
+		}
+
+		// 部分choice失败时，错误放在对应choice中，保留已收到的内容
+		choices := make([]map[string]interface{}, n)
+		for i := range choices {
+			choices[i] = map[string]interface{}{
+				"message": map[string]interface{}{
+					"role":    "assistant",
+					"content": contents[i],
+				},
+				"finish_reason": "stop",
+				"index":         i,
+			}
+			if errs[i] != nil {
+				_, body := streamErrorBody(errs[i])
+				choices[i]["finish_reason"] = "error"
+				choices[i]["error"] = body.Error
+			}
+		}
+		response := map[string]interface{}{
+			"id":      generateUUID(),
+			"object":  "chat.completion",
+			"created": getCurrentTimestamp(),
+			"model":   openAIReq.Model,
+			"choices": choices,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "server_error", "streaming_unsupported", "", "Streaming unsupported")
+		return
+	}
+	setStreamHeaders(w)
+	metricsFor(r).stream = true
+
+	// 多个choice并发输出，写出时加锁，各choice的chunk按到达顺序交错
+	var mu sync.Mutex
+	writeChunk := func(choice ChunkChoice) {
+		openAIResp := OpenAIResponse{
+			Id:      generateUUID(),
+			Object:  "chat.completion.chunk",
+			Created: getCurrentTimestamp(),
+			Model:   openAIReq.Model,
+			Choices: []ChunkChoice{choice},
+		}
+		respData, _ := json.Marshal(openAIResp)
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, "data: %s\n\n", string(respData))
+		flusher.Flush()
+	}
+	// finishChoice 发送结束chunk，失败时 finish_reason 为 error 并带上错误
+	finishChoice := func(index int, err error) {
+		choice := ChunkChoice{Index: index, FinishReason: "stop"}
+		if err != nil {
+			_, body := streamErrorBody(err)
+			choice.FinishReason = "error"
+			choice.Error = &body.Error
+		}
+		writeChunk(choice)
+	}
+
+	var wg sync.WaitGroup
+	for i, resp := range resps {
+		if resp == nil {
+			finishChoice(i, errs[i])
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = readMerlin(r, resp.Body, func(content string) {
+				if content == "" {
+					return
+				}
+				choice := ChunkChoice{Index: i}
+				choice.Delta.Content = content
+				writeChunk(choice)
+			})
+			// 只有一个choice时错误单独作为事件发送，见下文
+			if clientGone(r) || (n == 1 && errs[i] != nil) {
+				return
+			}
+			finishChoice(i, errs[i])
+		}()
+	}
+	wg.Wait()
+	if clientGone(r) {
+		logCanceled(r, "stream")
 		return
 	}
+	if n == 1 && errs[0] != nil {
+		// 流中途失败时发送错误事件，不伪装成正常结束
+		_, body := streamErrorBody(errs[0])
+		respData, _ := json.Marshal(body)
+		fmt.Fprintf(w, "data: %s\n\n", string(respData))
+	}
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// openChoices 为每个choice并发获取token并调用Merlin，resps 与 errs 按choice下标对应
+func openChoices(r *http.Request, merlinReqs []MerlinRequest) ([]*http.Response, []error) {
+	resps := make([]*http.Response, len(merlinReqs))
+	errs := make([]error, len(merlinReqs))
+	var wg sync.WaitGroup
+	for i, merlinReq := range merlinReqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resps[i], errs[i] = dialMerlin(r, merlinReq)
+		}()
+	}
+	wg.Wait()
+	return resps, errs
+}
+
+func closeAll(resps []*http.Response) {
+	for _, resp := range resps {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// firstError 所有choice都失败时返回第一个错误，否则返回nil
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return errs[0]
+}
+
+// ---- 健康检查 ----
+
+var startTime = time.Now()
+
+// 就绪检查是否获取一次上游 token，结果缓存 READY_CHECK_TTL
+var (
+	readyTokenCheck = getEnvOrDefault("READY_TOKEN_CHECK", "") == "true"
+	readyCheckTTL   = getEnvDuration("READY_CHECK_TTL", 30*time.Second)
+)
+
+type HealthResponse struct {
+	Status        string                 `json:"status"` // ok / ready / not_ready
+	UptimeSeconds int64                  `json:"uptime_seconds"`
+	Checks        map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status    string `json:"status"` // ok / error / skipped
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+	CheckedAt int64  `json:"checked_at,omitempty"`
+}
+
+// tokenProbe 缓存最近一次 token 获取结果，并发的检查请求共用同一次探测
+var tokenProbe struct {
+	sync.Mutex
+	result HealthCheck
+	at     time.Time
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthResponse{Status: "ok", UptimeSeconds: int64(time.Since(startTime).Seconds())})
+}
+
+// handleReadyz 检查必需的环境变量，READY_TOKEN_CHECK=true 时再检查能否获取上游 token
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]HealthCheck{"config": {Status: "ok"}}
+	if getEnvOrDefault("UUID", "") == "" {
+		checks["config"] = HealthCheck{Status: "error", Error: "UUID is not set"}
+	}
+	if readyTokenCheck {
+		checks["token"] = probeToken(r.Context())
+	} else {
+		checks["token"] = HealthCheck{Status: "skipped"}
+	}
+
+	resp := HealthResponse{Status: "ready", UptimeSeconds: int64(time.Since(startTime).Seconds()), Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.Status == "error" {
+			resp.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, status, resp)
+}
+
+func probeToken(ctx context.Context) HealthCheck {
+	tokenProbe.Lock()
+	defer tokenProbe.Unlock()
+	if !tokenProbe.at.IsZero() && time.Since(tokenProbe.at) < readyCheckTTL {
+		return tokenProbe.result
+	}
+
+	// 探测不跟随检查请求取消，结果会被后续请求复用
+	probeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	result := HealthCheck{Status: "ok"}
+	if _, err := getToken(probeCtx); err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+		log.Printf("readiness token check failed: %v", err)
+	}
+	result.LatencyMS = time.Since(start).Milliseconds()
+	result.CheckedAt = start.Unix()
+
+	tokenProbe.result, tokenProbe.at = result, time.Now()
+	return result
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+var errImageNotLast = errors.New("image_url is only supported in the last message")
+
+// newMerlinRequest 最后一条消息作为提问，之前的消息按 "role: 内容" 拼接为 context
+func newMerlinRequest(messages []Message, model string) (MerlinRequest, error) {
 	var contextMessages []string
-	for i := 0; i < len(openAIReq.Messages)-1; i++ {
-		msg := openAIReq.Messages[i]
-		contextMessages = append(contextMessages, fmt.Sprintf("%s: %s", msg.Role, msg.Content))
+	for i := 0; i < len(messages)-1; i++ {
+		msg := messages[i]
+		if len(msg.Content.Images) > 0 {
+			return MerlinRequest{}, errImageNotLast
+		}
+		contextMessages = append(contextMessages, fmt.Sprintf("%s: %s", msg.Role, msg.Content.Text))
+	}
+	contextText := strings.Join(contextMessages, "\n")
+	lastMessage := messages[len(messages)-1]
+	attachments := make([]MerlinAttachment, 0, len(lastMessage.Content.Images))
+	for _, url := range lastMessage.Content.Images {
+		attachments = append(attachments, MerlinAttachment{Type: "IMAGE", URL: url})
 	}
-	context := strings.Join(contextMessages, "\n")
-	merlinReq := MerlinRequest{
-		Attachments: make([]interface{}, 0),
+	return MerlinRequest{
+		Attachments: attachments,
 		ChatId:      generateV1UUID(),
 		Language:    "AUTO",
 		Message: struct {
@@ -145,14 +823,14 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			Id       string `json:"id"`
 			ParentId string `json:"parentId"`
 		}{
-			Content:  openAIReq.Messages[len(openAIReq.Messages)-1].Content,
-			Context:  context,
+			Content:  lastMessage.Content.Text,
+			Context:  contextText,
 			ChildId:  generateUUID(),
 			Id:       generateUUID(),
 			ParentId: "root",
 		},
 		Mode:  "UNIFIED_CHAT",
-		Model: openAIReq.Model,
+		Model: model,
 		Metadata: struct {
 			LargeContext  bool `json:"largeContext"`
 			MerlinMagic   bool `json:"merlinMagic"`
@@ -164,16 +842,44 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			ProFinderMode: false,
 			WebAccess:     false,
 		},
+	}, nil
+}
+
+// openMerlin 获取token并调用Merlin，检查状态码。返回nil时错误已写回或客户端已断开；
+// 成功时调用方负责关闭响应体
+func openMerlin(w http.ResponseWriter, r *http.Request, merlinReq MerlinRequest) *http.Response {
+	resp, err := dialMerlin(r, merlinReq)
+	if err != nil {
+		if !clientGone(r) {
+			writeStreamError(w, err)
+		}
+		return nil
+	}
+	return resp
+}
+
+// dialMerlin 与 openMerlin 相同，但错误返回给调用方而不写回：客户端断开时为 ctx 错误，
+// 服务关闭时为 errShutdown，其他失败为 *httpError
+func dialMerlin(r *http.Request, merlinReq MerlinRequest) (*http.Response, error) {
+	ctx := r.Context()
+	token, err := getToken(ctx)
+	if clientGone(r) {
+		logCanceled(r, "token")
+		return nil, ctx.Err()
+	}
+	if shuttingDown(r) {
+		return nil, errShutdown
 	}
-	token, err := getToken()
 	if err != nil {
-		http.Error(w, "Failed to get token: "+err.Error(), http.StatusInternalServerError)
-		return
+		metricTokenFetches.add(1, "failure")
+		return nil, &httpError{status: http.StatusBadGateway, body: newErrorResponse("upstream_error", "token_unavailable", "", upstreamDetail("Failed to get upstream token", err.Error()))}
 	}
-	client := &http.Client{}
+	metricTokenFetches.add(1, "success")
 	merlinReqBody, _ := json.Marshal(merlinReq)
 
-	req, _ := http.NewRequest("POST", "https://arcane.getmerlin.in/v1/thread/unified", strings.NewReader(string(merlinReqBody)))
+	// 绑定下游请求上下文，客户端断开时上游请求随之取消
+	upstreamCtx, cancelUpstream := context.WithCancelCause(ctx)
+	req, _ := http.NewRequestWithContext(upstreamCtx, "POST", "https://arcane.getmerlin.in/v1/thread/unified", strings.NewReader(string(merlinReqBody)))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "text/event-stream, text/event-stream")
 	req.Header.Set("Authorization", "Bearer "+token)
@@ -186,157 +892,525 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 	req.Header.Set("Sec-Fetch-Mode", "cors")
 	req.Header.Set("Sec-Fetch-Dest", "empty")
 	req.Header.Set("host", "arcane.getmerlin.in")
-	var flusher http.Flusher
-	if openAIReq.Stream {
-		var ok bool
-		flusher, ok = w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
-			return
+
+	start := time.Now()
+	resp, err := merlinClient.Do(req)
+	if ctx.Err() != nil {
+		cancelUpstream(nil)
+		if resp != nil {
+			resp.Body.Close()
 		}
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-		w.Header().Set("X-Accel-Buffering", "no")
-		w.Header().Set("Transfer-Encoding", "chunked")
-		defer func() {
-			if flusher != nil {
-				flusher.Flush()
-			}
-		}()
-	} else {
-		w.Header().Set("Content-Type", "application/json")
+		if shuttingDown(r) {
+			return nil, errShutdown
+		}
+		logCanceled(r, "upstream")
+		return nil, ctx.Err()
 	}
-
-	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		cancelUpstream(nil)
+		return nil, upstreamError(0, err.Error())
 	}
-	defer resp.Body.Close()
+	resp.Body = withIdleTimeout(upstreamCtx, cancelUpstream, resp.Body, start)
 
-	if !openAIReq.Stream {
-		var fullContent string
-		reader := bufio.NewReader(resp.Body)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		return nil, upstreamError(resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+// readMerlin 逐条读取 Merlin 的 message 事件并回调其内容。
+// 正常读完返回nil，读取失败（含流空闲超时）时返回错误
+func readMerlin(r *http.Request, body io.Reader, onContent func(string)) error {
+	reader := bufio.NewReader(body)
+
+	// 首字、总耗时和输出字数计入指标
+	rm := metricsFor(r)
+	ib, timed := body.(*idleTimeoutBody)
+	gotFirst := false
+	chars := 0
+	defer func() {
+		if timed {
+			metricUpstreamDuration.observe(time.Since(ib.start).Seconds(), rm.endpoint)
+		}
+		if chars > 0 {
+			metricOutputChars.add(float64(chars), rm.endpoint, rm.model)
+		}
+	}()
+	for {
+		line, err := reader.ReadString('\n')
+		if r.Context().Err() != nil {
+			if shuttingDown(r) {
+				return errShutdown
+			}
+			return r.Context().Err()
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(line), "event: message") {
+			dataLine, err := reader.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			dataLine = strings.TrimSpace(dataLine)
+			if !strings.HasPrefix(dataLine, "data: ") {
+				continue
+			}
+			var merlinResp MerlinResponse
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &merlinResp); err != nil {
 				continue
 			}
+			if content := merlinResp.Data.Content; content != "" {
+				if !gotFirst && timed {
+					metricFirstToken.observe(time.Since(ib.start).Seconds(), rm.endpoint)
+				}
+				gotFirst = true
+				chars += utf8.RuneCountInString(content)
+			}
+			onContent(merlinResp.Data.Content)
+		}
+	}
+}
 
-			line = strings.TrimSpace(line)
+func setStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Transfer-Encoding", "chunked")
+}
 
-			if strings.HasPrefix(line, "event: message") {
-				dataLine, err := reader.ReadString('\n')
-				if err != nil {
-					continue
-				}
-				dataLine = strings.TrimSpace(dataLine)
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              ResponseInput     `json:"input"`
+	Instructions       string            `json:"instructions"`
+	PreviousResponseId string            `json:"previous_response_id"`
+	Stream             bool              `json:"stream"`
+	Store              *bool             `json:"store"`
+	Metadata           map[string]string `json:"metadata"`
+}
 
-				if strings.HasPrefix(dataLine, "data: ") {
-					dataStr := strings.TrimPrefix(dataLine, "data: ")
-					var merlinResp MerlinResponse
-					if err := json.Unmarshal([]byte(dataStr), &merlinResp); err != nil {
-						continue
-					}
-					if merlinResp.Data.Content != " " {
-						fullContent += merlinResp.Data.Content
+// ResponseInput Responses API 的 input，字符串等价于一条 user 消息
+type ResponseInput []Message
+
+func (in *ResponseInput) UnmarshalJSON(data []byte) error {
+	// null 视为未传，由调用方返回 input is required
+	if string(data) == "null" {
+		*in = nil
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = ResponseInput{{Role: "user", Content: MessageContent{Text: text}}}
+		return nil
+	}
+	var items []struct {
+		Type    string          `json:"type"`
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*in = nil
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+		case "reasoning":
+			continue
+		default:
+			return fmt.Errorf("input item type %q is not supported", item.Type)
+		}
+		msg := Message{Role: item.Role}
+		if err := json.Unmarshal(item.Content, &msg.Content.Text); err != nil {
+			var parts []struct {
+				Type     string `json:"type"`
+				Text     string `json:"text"`
+				ImageURL string `json:"image_url"`
+			}
+			if err := json.Unmarshal(item.Content, &parts); err != nil {
+				return err
+			}
+			var texts []string
+			for _, p := range parts {
+				switch p.Type {
+				case "input_text", "output_text":
+					texts = append(texts, p.Text)
+				case "input_image":
+					if p.ImageURL != "" {
+						msg.Content.Images = append(msg.Content.Images, p.ImageURL)
 					}
 				}
 			}
+			msg.Content.Text = strings.Join(texts, "\n")
 		}
+		*in = append(*in, msg)
+	}
+	return nil
+}
 
-		response := map[string]interface{}{
-			"id":      generateUUID(),
-			"object":  "chat.completion",
-			"created": getCurrentTimestamp(),
-			"model":   openAIReq.Model,
-			"choices": []map[string]interface{}{
-				{
-					"message": map[string]interface{}{
-						"role":    "assistant",
-						"content": fullContent,
-					},
-					"finish_reason": "stop",
-					"index":         0,
-				},
-			},
+type ResponseObject struct {
+	Id                 string               `json:"id"`
+	Object             string               `json:"object"`
+	CreatedAt          int64                `json:"created_at"`
+	Status             string               `json:"status"`
+	Model              string               `json:"model"`
+	Instructions       *string              `json:"instructions"`
+	PreviousResponseId *string              `json:"previous_response_id"`
+	Output             []ResponseOutputItem `json:"output"`
+	Error              *ResponseError       `json:"error"`
+	Usage              *struct{}            `json:"usage"` // Merlin 不返回用量
+	Store              bool                 `json:"store"`
+	Metadata           map[string]string    `json:"metadata"`
+}
+
+type ResponseOutputItem struct {
+	Type    string               `json:"type"`
+	Id      string               `json:"id"`
+	Status  string               `json:"status"`
+	Role    string               `json:"role"`
+	Content []ResponseOutputText `json:"content"`
+}
+
+type ResponseOutputText struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// storedResponse 保存的响应及续接对话所需的完整历史（不含 instructions）
+type storedResponse struct {
+	response  *ResponseObject
+	messages  []Message
+	expiresAt time.Time
+}
+
+// responseStore 内存中的响应存储，按写入顺序淘汰，超过 TTL 的记录总在队首
+var responseStore = struct {
+	sync.Mutex
+	entries map[string]*storedResponse
+	order   []string
+}{entries: make(map[string]*storedResponse)}
+
+var (
+	responseStoreMaxEntries = getEnvInt("RESPONSE_STORE_MAX_ENTRIES", 1000)
+	responseStoreTTL        = getEnvDuration("RESPONSE_STORE_TTL", 24*time.Hour)
+)
+
+func saveResponse(e *storedResponse) {
+	if responseStoreMaxEntries <= 0 {
+		return
+	}
+	responseStore.Lock()
+	defer responseStore.Unlock()
+	e.expiresAt = time.Now().Add(responseStoreTTL)
+	responseStore.entries[e.response.Id] = e
+	responseStore.order = append(responseStore.order, e.response.Id)
+	evictResponsesLocked()
+}
+
+func loadResponse(id string) (*storedResponse, bool) {
+	responseStore.Lock()
+	defer responseStore.Unlock()
+	evictResponsesLocked()
+	e, ok := responseStore.entries[id]
+	return e, ok
+}
+
+func evictResponsesLocked() {
+	now := time.Now()
+	for len(responseStore.order) > 0 {
+		id := responseStore.order[0]
+		if len(responseStore.order) <= responseStoreMaxEntries && responseStore.entries[id].expiresAt.After(now) {
+			break
 		}
-		json.NewEncoder(w).Encode(response)
+		delete(responseStore.entries, id)
+		responseStore.order = responseStore.order[1:]
+	}
+}
+
+func writeResponseNotFound(w http.ResponseWriter, id, param string) {
+	writeError(w, http.StatusNotFound, "invalid_request_error", "response_not_found", param, fmt.Sprintf("Response with id '%s' not found.", id))
+}
+
+// handleResponses OpenAI Responses API：POST /hf/v1/responses 与 GET /hf/v1/responses/{id}
+func handleResponses(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/hf/v1/responses"), "/")
+	if id != "" && r.Method == http.MethodGet {
+		stored, ok := loadResponse(id)
+		if !ok {
+			writeResponseNotFound(w, id, "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stored.response)
+		return
+	}
+	if id != "" || r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method_not_allowed", "", "Method not allowed")
 		return
 	}
 
-	reader := bufio.NewReader(resp.Body)
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			continue
+	var respReq ResponsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&respReq); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid_json", "", "Invalid JSON body: "+err.Error())
+		return
+	}
+	if len(respReq.Input) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "missing_required_parameter", "input", "input is required")
+		return
+	}
+
+	// 续接对话时先重放上一轮保存的历史，instructions 不继承
+	var history []Message
+	if respReq.PreviousResponseId != "" {
+		prev, ok := loadResponse(respReq.PreviousResponseId)
+		if !ok {
+			writeResponseNotFound(w, respReq.PreviousResponseId, "previous_response_id")
+			return
+		}
+		history = append(history, prev.messages...)
+	}
+	history = append(history, respReq.Input...)
+	messages := history
+	if respReq.Instructions != "" {
+		messages = append([]Message{{Role: "system", Content: MessageContent{Text: respReq.Instructions}}}, history...)
+	}
+	metricsFor(r).model = respReq.Model
+	merlinReq, err := newMerlinRequest(messages, respReq.Model)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "unsupported_content", "input", err.Error())
+		return
+	}
+
+	store := respReq.Store == nil || *respReq.Store
+	obj := &ResponseObject{
+		Id:        "resp_" + strings.ReplaceAll(generateUUID(), "-", ""),
+		Object:    "response",
+		CreatedAt: getCurrentTimestamp(),
+		Status:    "in_progress",
+		Model:     respReq.Model,
+		Output:    []ResponseOutputItem{},
+		Store:     store,
+		Metadata:  respReq.Metadata,
+	}
+	if obj.Metadata == nil {
+		obj.Metadata = map[string]string{}
+	}
+	if respReq.Instructions != "" {
+		obj.Instructions = &respReq.Instructions
+	}
+	if respReq.PreviousResponseId != "" {
+		obj.PreviousResponseId = &respReq.PreviousResponseId
+	}
+	log.Printf("responses id=%s previous=%s stream=%v", obj.Id, respReq.PreviousResponseId, respReq.Stream)
+
+	resp := openMerlin(w, r, merlinReq)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// 非流式时 emit 为空操作，两种模式共用同一套组装逻辑
+	emit := func(eventType string, fields map[string]interface{}) {}
+	if respReq.Stream {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "server_error", "streaming_unsupported", "", "Streaming unsupported")
+			return
+		}
+		setStreamHeaders(w)
+		metricsFor(r).stream = true
+		seq := 0
+		emit = func(eventType string, fields map[string]interface{}) {
+			fields["type"] = eventType
+			fields["sequence_number"] = seq
+			seq++
+			data, _ := json.Marshal(fields)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data)
+			flusher.Flush()
 		}
+		emit("response.created", map[string]interface{}{"response": obj})
+		emit("response.in_progress", map[string]interface{}{"response": obj})
+	}
 
-		if strings.HasPrefix(line, "event: message") {
-			dataLine, _ := reader.ReadString('\n')
-			var merlinResp MerlinResponse
-			json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &merlinResp)
-
-			if merlinResp.Data.Content != "" {
-				openAIResp := OpenAIResponse{
-					Id:      generateUUID(),
-					Object:  "chat.completion.chunk",
-					Created: getCurrentTimestamp(),
-					Model:   openAIReq.Model,
-					Choices: []struct {
-						Delta struct {
-							Content string `json:"content"`
-						} `json:"delta"`
-						Index        int    `json:"index"`
-						FinishReason string `json:"finish_reason"`
-					}{{
-						Delta: struct {
-							Content string `json:"content"`
-						}{
-							Content: merlinResp.Data.Content,
-						},
-						Index:        0,
-						FinishReason: "",
-					}},
-				}
+	item := ResponseOutputItem{Type: "message", Id: "msg_" + strings.ReplaceAll(generateUUID(), "-", ""), Status: "in_progress", Role: "assistant", Content: []ResponseOutputText{}}
+	emit("response.output_item.added", map[string]interface{}{"output_index": 0, "item": item})
+	emit("response.content_part.added", map[string]interface{}{"item_id": item.Id, "output_index": 0, "content_index": 0,
+		"part": ResponseOutputText{Type: "output_text", Annotations: []interface{}{}}})
 
-				respData, _ := json.Marshal(openAIResp)
-				fmt.Fprintf(w, "data: %s\n\n", string(respData))
-				flusher.Flush()
-			}
+	var text strings.Builder
+	err = readMerlin(r, resp.Body, func(content string) {
+		if content == "" {
+			return
 		}
+		text.WriteString(content)
+		emit("response.output_text.delta", map[string]interface{}{"item_id": item.Id, "output_index": 0, "content_index": 0, "delta": content})
+	})
+	if clientGone(r) {
+		logCanceled(r, "responses")
+		return
 	}
 
-	finalResp := OpenAIResponse{
-		Id:      generateUUID(),
-		Object:  "chat.completion.chunk",
-		Created: getCurrentTimestamp(),
-		Model:   openAIReq.Model,
-		Choices: []struct {
-			Delta struct {
-				Content string `json:"content"`
-			} `json:"delta"`
-			Index        int    `json:"index"`
-			FinishReason string `json:"finish_reason"`
-		}{{
-			Delta: struct {
-				Content string `json:"content"`
-			}{Content: ""},
-			Index:        0,
-			FinishReason: "stop",
-		}},
-	}
-	respData, _ := json.Marshal(finalResp)
-	fmt.Fprintf(w, "data: %s\n\n", string(respData))
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	part := ResponseOutputText{Type: "output_text", Text: text.String(), Annotations: []interface{}{}}
+	item.Content = []ResponseOutputText{part}
+	item.Status = "completed"
+	if err != nil {
+		if !respReq.Stream {
+			writeStreamError(w, err)
+			return
+		}
+		_, body := streamErrorBody(err)
+		item.Status = "incomplete"
+		obj.Status = "failed"
+		obj.Output = []ResponseOutputItem{item}
+		obj.Error = &ResponseError{Code: *body.Error.Code, Message: body.Error.Message}
+		emit("response.failed", map[string]interface{}{"response": obj})
+		return
+	}
+	emit("response.output_text.done", map[string]interface{}{"item_id": item.Id, "output_index": 0, "content_index": 0, "text": part.Text})
+	emit("response.content_part.done", map[string]interface{}{"item_id": item.Id, "output_index": 0, "content_index": 0, "part": part})
+	emit("response.output_item.done", map[string]interface{}{"output_index": 0, "item": item})
+
+	obj.Status = "completed"
+	obj.Output = []ResponseOutputItem{item}
+	if store {
+		saveResponse(&storedResponse{
+			response: obj,
+			messages: append(history, Message{Role: "assistant", Content: MessageContent{Text: part.Text}}),
+		})
+	}
+
+	if respReq.Stream {
+		emit("response.completed", map[string]interface{}{"response": obj})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+var debugMode = getEnvOrDefault("DEBUG_MODE", "") == "true"
+
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// httpError 打开上游失败（获取token、连接或上游状态码）时要返回给客户端的错误
+type httpError struct {
+	status int
+	body   ErrorResponse
+}
+
+func (e *httpError) Error() string {
+	return e.body.Error.Message
+}
+
+func newErrorResponse(errType, code, param, message string) ErrorResponse {
+	var resp ErrorResponse
+	resp.Error.Message = message
+	resp.Error.Type = errType
+	if code != "" {
+		resp.Error.Code = &code
+	}
+	if param != "" {
+		resp.Error.Param = &param
+	}
+	return resp
+}
+
+// writeError 以 OpenAI 格式返回错误
+func writeError(w http.ResponseWriter, status int, errType, code, param, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newErrorResponse(errType, code, param, message))
+}
+
+// streamErrorBody 读取上游流失败时的状态码和错误体，空闲超时映射为504
+func streamErrorBody(err error) (int, ErrorResponse) {
+	var he *httpError
+	if errors.As(err, &he) {
+		return he.status, he.body
+	}
+	if errors.Is(err, errShutdown) {
+		return http.StatusServiceUnavailable, newErrorResponse("server_error", "server_shutting_down", "", "Server is shutting down, please retry the request")
+	}
+	log.Printf("upstream stream failed: %v", err)
+	if errors.Is(err, errStreamIdle) {
+		return http.StatusGatewayTimeout, newErrorResponse("upstream_error", "upstream_timeout", "", upstreamDetail("Upstream stream timed out", err.Error()))
+	}
+	return http.StatusBadGateway, newErrorResponse("upstream_error", "upstream_interrupted", "", upstreamDetail("Upstream stream was interrupted", err.Error()))
+}
+
+func writeStreamError(w http.ResponseWriter, err error) {
+	status, body := streamErrorBody(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// upstreamDetail 上游原始错误文本只在 DEBUG_MODE=true 时返回给客户端
+func upstreamDetail(message, detail string) string {
+	if debugMode && detail != "" {
+		return message + ": " + detail
+	}
+	return message
+}
+
+// upstreamError 按上游状态码映射错误类型，status 为0表示未拿到响应
+func upstreamError(status int, detail string) *httpError {
+	newErr := func(status int, errType, code, message string) *httpError {
+		return &httpError{status: status, body: newErrorResponse(errType, code, "", upstreamDetail(message, detail))}
+	}
+	switch {
+	case status == 0:
+		return newErr(http.StatusBadGateway, "upstream_error", "upstream_unavailable", "Failed to connect to upstream")
+	case status == http.StatusUnauthorized:
+		return newErr(http.StatusUnauthorized, "authentication_error", "upstream_token_expired", "Upstream token is invalid or expired")
+	case status == http.StatusForbidden:
+		return newErr(http.StatusForbidden, "permission_error", "upstream_forbidden", "Upstream refused the request")
+	case status == http.StatusTooManyRequests:
+		return newErr(http.StatusTooManyRequests, "rate_limit_exceeded", "rate_limit_exceeded", "Upstream rate limit exceeded")
+	case status == http.StatusBadRequest:
+		return newErr(http.StatusBadRequest, "invalid_request_error", "upstream_rejected", "Upstream rejected the request")
+	default:
+		return newErr(http.StatusBadGateway, "upstream_error", "upstream_error", fmt.Sprintf("Upstream error (status %d)", status))
+	}
+}
+
+// errShutdown 服务关闭、等待超时后取消剩余请求时使用的 cause，
+// 与客户端断开不同，此时连接仍在，需要向客户端输出错误
+var errShutdown = errors.New("server shutting down")
+
+func shuttingDown(r *http.Request) bool {
+	return errors.Is(context.Cause(r.Context()), errShutdown)
+}
+
+// clientGone 下游客户端是否已断开，服务关闭导致的取消不算在内
+func clientGone(r *http.Request) bool {
+	return r.Context().Err() != nil && !shuttingDown(r)
+}
+
+// logCanceled 客户端断开单独记录，不算作错误
+func logCanceled(r *http.Request, stage string) {
+	log.Printf("client disconnected, upstream canceled: path=%s stage=%s", r.URL.Path, stage)
 }
 
 func generateUUID() string {
@@ -352,11 +1426,50 @@ func getCurrentTimestamp() int64 {
 	return time.Now().Unix()
 }
 
+// 收到退出信号后等待进行中请求完成的最长时间
+var shutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
 func main() {
 	port := getEnvOrDefault("PORT", "7860")
 	http.HandleFunc("/", Handler)
+
+	// 所有请求的上下文都派生自 baseCtx，等待超时后以 errShutdown 取消剩余请求
+	baseCtx, cancelRequests := context.WithCancelCause(context.Background())
+	defer cancelRequests(nil)
+	srv := &http.Server{
+		Addr:              ":" + port,
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
 	fmt.Printf("Server starting on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
+		stop()
 		fmt.Printf("Error starting server: %v\n", err)
+		os.Exit(1)
+	case <-sigCtx.Done():
+	}
+	// 恢复默认信号处理，再次收到信号时立即退出
+	stop()
+
+	log.Printf("shutting down, waiting up to %s for in-flight requests", shutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	err := srv.Shutdown(drainCtx)
+	cancel()
+	if err != nil {
+		log.Printf("drain timed out, canceling remaining requests: %v", err)
+		cancelRequests(errShutdown)
+		// 留出时间让处理函数写完错误事件
+		finalCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := srv.Shutdown(finalCtx); err != nil {
+			srv.Close()
+		}
+		cancel()
 	}
+	log.Printf("server stopped")
 }
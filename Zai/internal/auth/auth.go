@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"Zai/internal/config"
+)
+
+var (
+	ErrInvalidKey  = errors.New("invalid api key")
+	ErrKeyDisabled = errors.New("api key disabled")
+	ErrKeyExpired  = errors.New("api key expired")
+)
+
+// Key 下游API key（只保存哈希）
+type Key struct {
+	Name      string
+	Enabled   bool
+	Models    []string // 为空表示不限制
+	ExpiresAt time.Time
+}
+
+// AllowsModel 判断该key能否调用指定模型
+func (k *Key) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, m := range k.Models {
+		if m == "*" || strings.EqualFold(m, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store 以sha256哈希为索引的key表
+type Store struct {
+	keys map[string]*Key
+}
+
+// HashKey 计算key的sha256十六进制摘要，配置文件中保存的就是这个值
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewStore 根据配置构建key表。default_key 作为名为 "default" 的不限模型key加入。
+func NewStore(cfg *config.Config) (*Store, error) {
+	s := &Store{keys: make(map[string]*Key)}
+	if cfg.DefaultKey != "" {
+		s.keys[HashKey(cfg.DefaultKey)] = &Key{Name: "default", Enabled: true}
+	}
+	for _, kc := range cfg.Keys {
+		hash := strings.ToLower(kc.KeyHash)
+		if _, dup := s.keys[hash]; dup {
+			return nil, fmt.Errorf("key %q 的哈希与其他key重复", kc.Name)
+		}
+		k := &Key{
+			Name:    kc.Name,
+			Enabled: kc.Enabled == nil || *kc.Enabled,
+			Models:  kc.Models,
+		}
+		if kc.ExpiresAt != nil {
+			k.ExpiresAt = *kc.ExpiresAt
+		}
+		s.keys[hash] = k
+	}
+	return s, nil
+}
+
+// Authenticate 校验明文key，返回对应的key信息
+func (s *Store) Authenticate(key string) (*Key, error) {
+	k, ok := s.keys[HashKey(key)]
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	if !k.Enabled {
+		return k, ErrKeyDisabled
+	}
+	if !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt) {
+		return k, ErrKeyExpired
+	}
+	return k, nil
+}
+
+type ctxKey struct{}
+
+// WithKey 把通过鉴权的key挂到请求上下文
+func WithKey(ctx context.Context, k *Key) context.Context {
+	return context.WithValue(ctx, ctxKey{}, k)
+}
+
+// KeyFromContext 取出请求上下文中的key，不存在时返回nil
+func KeyFromContext(ctx context.Context) *Key {
+	k, _ := ctx.Value(ctxKey{}).(*Key)
+	return k
+}
+
+// KeyName 返回上下文中key的名称，便于日志使用
+func KeyName(ctx context.Context) string {
+	if k := KeyFromContext(ctx); k != nil {
+		return k.Name
+	}
+	return "-"
+}
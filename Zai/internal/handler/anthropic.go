@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"Zai/internal/auth"
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+	"Zai/internal/util"
+)
+
+// HandleAnthropicMessages Anthropic Messages API（POST /v1/messages）
+func (h *Handler) HandleAnthropicMessages(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	slog.DebugContext(r.Context(), "收到anthropic messages请求")
+
+	key, apiErr := h.checkKey(r)
+	if apiErr != nil {
+		writeAnthropicError(w, apiErr)
+		return
+	}
+	ctx := auth.WithKey(r.Context(), key)
+
+	var req model.AnthropicRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.DebugContext(ctx, "JSON解析失败", "error", err)
+		writeAnthropicError(w, &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Invalid JSON body: " + err.Error()})
+		return
+	}
+	if req.Model == "" {
+		req.Model = h.cfg.ModelName
+	}
+	modelCfg, apiErr := h.checkModel(ctx, key, req.Model)
+	if apiErr != nil {
+		writeAnthropicError(w, apiErr)
+		return
+	}
+	if len(req.Messages) == 0 {
+		writeAnthropicError(w, &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "messages: at least one message is required"})
+		return
+	}
+	if req.MaxTokens <= 0 {
+		writeAnthropicError(w, &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "max_tokens: must be greater than 0"})
+		return
+	}
+
+	// system 与各消息的文本块转换为上游纯文本消息
+	messages := make([]model.UpstreamMessage, 0, len(req.Messages)+1)
+	if system := req.System.Text(); system != "" {
+		messages = append(messages, model.UpstreamMessage{Role: "system", Content: system})
+	}
+	for _, m := range req.Messages {
+		if m.Content.HasImages() {
+			writeAnthropicError(w, errImageUnsupported)
+			return
+		}
+		messages = append(messages, model.UpstreamMessage{Role: m.Role, Content: m.Content.Text()})
+	}
+
+	params := map[string]interface{}{"max_tokens": req.MaxTokens}
+	if req.Temperature != nil {
+		params["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		params["top_p"] = *req.TopP
+	}
+	if len(req.StopSequences) > 0 {
+		params["stop"] = req.StopSequences
+	}
+
+	upstreamReq := h.newUpstreamRequest(modelCfg, messages, params)
+	slog.InfoContext(ctx, "anthropic messages", "model", req.Model, "stream", req.Stream, "chat_id", upstreamReq.ChatID)
+
+	// 上游可能忽略 stop_sequences 和 max_tokens，由代理在回答上再执行一次，截断后立即取消上游请求
+	cc := newChoiceContexts(ctx, 1)[0]
+	defer cc.cancel(nil)
+	resp, err := h.openUpstream(cc, w, upstreamReq)
+	if errors.As(err, &apiErr) {
+		writeAnthropicError(w, apiErr)
+		return
+	} else if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	msgID := fmt.Sprintf("msg_%d", time.Now().UnixNano())
+	answer := newAnswerFilter(cc, req.StopSequences, req.MaxTokens)
+	if req.Stream {
+		h.streamAnthropic(ctx, w, resp, upstreamReq.ChatID, msgID, req.Model, answer)
+	} else {
+		h.collectAnthropic(ctx, w, resp, upstreamReq.ChatID, msgID, req.Model, answer)
+	}
+}
+
+// anthropicStopReason 返回 stop_reason 和 stop_sequence：命中 stop_sequences 为 stop_sequence，
+// 达到 max_tokens 为 max_tokens，否则为 end_turn
+func anthropicStopReason(a *answerFilter) (*string, *string) {
+	reason := "end_turn"
+	switch {
+	case a.Stopped():
+		reason = "stop_sequence"
+		matched := a.Matched()
+		return &reason, &matched
+	case a.Reached():
+		reason = "max_tokens"
+	}
+	return &reason, nil
+}
+
+func (h *Handler) collectAnthropic(ctx context.Context, w http.ResponseWriter, resp *http.Response, chatID, msgID, modelName string, answer *answerFilter) {
+	var thinking, text strings.Builder
+	var usage usageTracker
+	think := newThinkFilter("strip")
+	err := h.readUpstream(answer.cc, resp.Body, chatID, func(data *model.UpstreamData) {
+		usage.observe(data)
+		if data.Data.DeltaContent == "" {
+			return
+		}
+		if data.Data.Phase == "thinking" {
+			thinking.WriteString(think.Feed(data.Data.DeltaContent))
+			return
+		}
+		thinking.WriteString(think.Flush())
+		text.WriteString(answer.Feed(data.Data.DeltaContent))
+	})
+	err = answer.result(err)
+	thinking.WriteString(think.Flush())
+	if clientGone(ctx) {
+		logCanceled(ctx, chatID, "anthropic非流式")
+		return
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		writeAnthropicError(w, apiErr)
+		return
+	}
+	text.WriteString(answer.Flush())
+
+	u := usage.usage()
+	logUsage(ctx, chatID, u)
+
+	var content []model.AnthropicBlock
+	if thinking.Len() > 0 {
+		signature := ""
+		content = append(content, model.AnthropicBlock{Type: "thinking", Thinking: thinking.String(), Signature: &signature})
+	}
+	content = append(content, model.AnthropicBlock{Type: "text", Text: text.String()})
+	stopReason, stopSequence := anthropicStopReason(answer)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.AnthropicResponse{
+		ID:           msgID,
+		Type:         "message",
+		Role:         "assistant",
+		Model:        modelName,
+		Content:      content,
+		StopReason:   stopReason,
+		StopSequence: stopSequence,
+		Usage:        model.AnthropicUsage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens},
+	})
+}
+
+// streamAnthropic 按 message_start → content_block_* → message_delta → message_stop 输出
+func (h *Handler) streamAnthropic(ctx context.Context, w http.ResponseWriter, resp *http.Response, chatID, msgID, modelName string, answer *answerFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAnthropicError(w, &apiError{Status: http.StatusInternalServerError, Type: errTypeServer, Message: "Streaming unsupported"})
+		return
+	}
+	metrics.MarkStream(ctx)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(event model.AnthropicStreamEvent) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		flusher.Flush()
+	}
+
+	send(model.AnthropicStreamEvent{
+		Type: "message_start",
+		Message: &model.AnthropicResponse{
+			ID:      msgID,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   modelName,
+			Content: []model.AnthropicBlock{},
+		},
+	})
+
+	// 当前打开的content block，thinking与text切换时关闭上一个
+	blockIndex := -1
+	blockType := ""
+	stopBlock := func() {
+		if blockType == "" {
+			return
+		}
+		idx := blockIndex
+		send(model.AnthropicStreamEvent{Type: "content_block_stop", Index: &idx})
+		blockType = ""
+	}
+	startBlock := func(t string) {
+		if blockType == t {
+			return
+		}
+		stopBlock()
+		blockIndex++
+		blockType = t
+		idx := blockIndex
+		block := map[string]interface{}{"type": t, t: ""}
+		if t == "thinking" {
+			block["signature"] = ""
+		}
+		send(model.AnthropicStreamEvent{Type: "content_block_start", Index: &idx, ContentBlock: block})
+	}
+
+	think := newThinkFilter("strip")
+	sendThinking := func(t string) {
+		if t == "" {
+			return
+		}
+		startBlock("thinking")
+		idx := blockIndex
+		send(model.AnthropicStreamEvent{Type: "content_block_delta", Index: &idx, Delta: &model.AnthropicDelta{Type: "thinking_delta", Thinking: t}})
+	}
+
+	sendText := func(t string) {
+		if t == "" {
+			return
+		}
+		startBlock("text")
+		idx := blockIndex
+		send(model.AnthropicStreamEvent{Type: "content_block_delta", Index: &idx, Delta: &model.AnthropicDelta{Type: "text_delta", Text: t}})
+	}
+
+	var usage usageTracker
+	err := h.readUpstream(answer.cc, resp.Body, chatID, func(data *model.UpstreamData) {
+		usage.observe(data)
+		if data.Data.DeltaContent == "" {
+			return
+		}
+		if data.Data.Phase == "thinking" {
+			sendThinking(think.Feed(data.Data.DeltaContent))
+			return
+		}
+		sendThinking(think.Flush())
+		sendText(answer.Feed(data.Data.DeltaContent))
+	})
+	if clientGone(ctx) {
+		logCanceled(ctx, chatID, "anthropic流式")
+		return
+	}
+	err = answer.result(err)
+	sendThinking(think.Flush())
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		sendText(answer.Flush())
+	}
+	stopBlock()
+
+	u := usage.usage()
+	logUsage(ctx, chatID, u)
+
+	if apiErr != nil {
+		body := anthropicErrorBody(apiErr)
+		send(model.AnthropicStreamEvent{Type: "error", Error: &body.Error})
+		return
+	}
+
+	stopReason, stopSequence := anthropicStopReason(answer)
+	send(model.AnthropicStreamEvent{
+		Type:  "message_delta",
+		Delta: &model.AnthropicDelta{StopReason: stopReason, StopSequence: stopSequence},
+		Usage: &model.AnthropicUsage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens},
+	})
+	send(model.AnthropicStreamEvent{Type: "message_stop"})
+	slog.DebugContext(ctx, "anthropic流式响应完成")
+}
+
+// anthropicErrorBody 把通用错误转换为 Anthropic 的错误类型
+func anthropicErrorBody(e *apiError) model.AnthropicErrorResponse {
+	errType := "api_error"
+	switch e.Type {
+	case errTypeInvalidRequest:
+		errType = "invalid_request_error"
+	case errTypeAuthentication:
+		errType = "authentication_error"
+	case errTypePermission:
+		errType = "permission_error"
+	case errTypeNotFound:
+		errType = "not_found_error"
+	case errTypeRateLimit:
+		errType = "rate_limit_error"
+	default:
+		if e.Status == http.StatusServiceUnavailable {
+			errType = "overloaded_error"
+		}
+	}
+	return model.AnthropicErrorResponse{Type: "error", Error: model.AnthropicError{Type: errType, Message: e.Message}}
+}
+
+func writeAnthropicError(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(anthropicErrorBody(e))
+}
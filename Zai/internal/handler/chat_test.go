@@ -0,0 +1,487 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Zai/internal/config"
+	"Zai/internal/model"
+	"Zai/internal/upstream/upstreamtest"
+)
+
+const testKey = "sk-test-key-0001"
+
+// newTestHandler 上游指向假服务器的Handler，重试不等待
+func newTestHandler(t *testing.T, edit func(cfg *config.Config)) (*Handler, *upstreamtest.Server) {
+	t.Helper()
+	up := upstreamtest.NewServer(t)
+	cfg := config.Default()
+	cfg.UpstreamURL = up.ChatURL()
+	cfg.OriginBase = up.URL
+	cfg.DefaultKey = testKey
+	cfg.UpstreamToken = "fixed-token"
+	cfg.Retry.InitialBackoff = 0
+	cfg.Retry.MaxBackoff = 0
+	if edit != nil {
+		edit(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("配置无效: %v", err)
+	}
+	h, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return h, up
+}
+
+func doChat(t *testing.T, h *Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testKey)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.HandleChatCompletions(rec, req)
+	return rec
+}
+
+// normalize 去掉随时间变化的 id/created，按key排序重新编码，便于逐字比较
+func normalize(t *testing.T, s string) string {
+	t.Helper()
+	var v map[string]any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("不是合法JSON: %v\n%s", err, s)
+	}
+	if _, ok := v["id"]; ok {
+		v["id"] = ""
+	}
+	if _, ok := v["created"]; ok {
+		v["created"] = 0
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// sseEvents 拆出响应中的 data 行，[DONE] 原样保留，其余归一化
+func sseEvents(t *testing.T, body string) []string {
+	t.Helper()
+	var events []string
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		data, ok := strings.CutPrefix(block, "data: ")
+		if !ok {
+			t.Fatalf("无法识别的SSE事件: %q", block)
+		}
+		if data == "[DONE]" {
+			events = append(events, data)
+			continue
+		}
+		events = append(events, normalize(t, data))
+	}
+	return events
+}
+
+func assertEvents(t *testing.T, body string, want ...string) {
+	t.Helper()
+	got := sseEvents(t, body)
+	for i := range want {
+		if want[i] != "[DONE]" {
+			want[i] = normalize(t, want[i])
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SSE事件不一致\n got: %s\nwant: %s", strings.Join(got, "\n      "), strings.Join(want, "\n      "))
+	}
+}
+
+// chunk 预期的流式chunk，delta 为JSON对象文本
+func chunk(delta, finish string) string {
+	c := `{"id":"","object":"chat.completion.chunk","created":0,"model":"GLM-4.5","choices":[{"index":0,"message":{"role":"","content":""},"delta":` + delta
+	if finish != "" {
+		c += `,"finish_reason":"` + finish + `"`
+	}
+	return c + `}]}`
+}
+
+var basicScript = upstreamtest.Script{Lines: []string{
+	upstreamtest.Thinking("<details type=\"reasoning\" done=\"false\">\n<summary>Thinking…</summary>\n> 想一想"),
+	upstreamtest.Answer("你好"),
+	upstreamtest.Answer("世界"),
+	upstreamtest.Done(&model.Usage{PromptTokens: 5, CompletionTokens: 7, TotalTokens: 12}),
+}}
+
+func TestChatStream(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript)
+
+	rec := doChat(t, h, `{"model":"GLM-4.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	assertEvents(t, rec.Body.String(),
+		chunk(`{"role":"assistant"}`, ""),
+		chunk(`{"reasoning_content":"想一想"}`, ""),
+		chunk(`{"content":"你好"}`, ""),
+		chunk(`{"content":"世界"}`, ""),
+		chunk(`{}`, "stop"),
+		"[DONE]",
+	)
+
+	reqs := up.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("上游请求数 = %d", len(reqs))
+	}
+	if got := reqs[0].Body.Messages; len(got) != 1 || got[0].Role != "user" || got[0].Content != "hi" {
+		t.Errorf("上游消息 = %+v", got)
+	}
+	if !reqs[0].Body.Stream {
+		t.Error("上游请求应为流式")
+	}
+}
+
+func TestChatStreamIncludeUsage(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript)
+
+	rec := doChat(t, h, `{"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	assertEvents(t, rec.Body.String(),
+		chunk(`{"role":"assistant"}`, ""),
+		chunk(`{"reasoning_content":"想一想"}`, ""),
+		chunk(`{"content":"你好"}`, ""),
+		chunk(`{"content":"世界"}`, ""),
+		chunk(`{}`, "stop"),
+		`{"id":"","object":"chat.completion.chunk","created":0,"model":"GLM-4.5","choices":[],
+			"usage":{"prompt_tokens":5,"completion_tokens":7,"total_tokens":12,"completion_tokens_details":{"reasoning_tokens":6}}}`,
+		"[DONE]",
+	)
+}
+
+func TestChatStreamThinkModes(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{"drop", []string{
+			chunk(`{"role":"assistant"}`, ""),
+			chunk(`{"content":"你好"}`, ""),
+			chunk(`{"content":"世界"}`, ""),
+			chunk(`{}`, "stop"),
+			"[DONE]",
+		}},
+		{"think", []string{
+			chunk(`{"role":"assistant"}`, ""),
+			chunk(`{"content":"<think>\n\n想一想"}`, ""),
+			chunk(`{"content":"你好"}`, ""),
+			chunk(`{"content":"世界"}`, ""),
+			chunk(`{}`, "stop"),
+			"[DONE]",
+		}},
+		{"strip", []string{
+			chunk(`{"role":"assistant"}`, ""),
+			chunk(`{"content":"想一想"}`, ""),
+			chunk(`{"content":"你好"}`, ""),
+			chunk(`{"content":"世界"}`, ""),
+			chunk(`{}`, "stop"),
+			"[DONE]",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			h, up := newTestHandler(t, nil)
+			up.Enqueue(basicScript)
+			rec := doChat(t, h, `{"stream":true,"reasoning_mode":"`+tt.mode+`","messages":[{"role":"user","content":"hi"}]}`)
+			assertEvents(t, rec.Body.String(), tt.want...)
+		})
+	}
+}
+
+func TestChatStreamSkipsMalformedLines(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Lines: []string{
+		": keep-alive",
+		upstreamtest.Malformed("broken"),
+		"data: ",
+		"event: message",
+		upstreamtest.Answer("好"),
+		upstreamtest.Done(nil),
+	}})
+
+	rec := doChat(t, h, `{"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	assertEvents(t, rec.Body.String(),
+		chunk(`{"role":"assistant"}`, ""),
+		chunk(`{"content":"好"}`, ""),
+		chunk(`{}`, "stop"),
+		"[DONE]",
+	)
+}
+
+func TestChatStreamUpstreamErrorEvent(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer("你好"),
+		upstreamtest.ErrorEvent(429, "too many requests"),
+		upstreamtest.Answer("不应输出"),
+	}})
+
+	rec := doChat(t, h, `{"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	assertEvents(t, rec.Body.String(),
+		chunk(`{"role":"assistant"}`, ""),
+		chunk(`{"content":"你好"}`, ""),
+		chunk(`{}`, "error"),
+		`{"error":{"message":"Upstream rate limit exceeded","type":"rate_limit_exceeded","param":null,"code":"rate_limit_exceeded"}}`,
+		"[DONE]",
+	)
+}
+
+func TestChatStreamIncomplete(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Lines: []string{upstreamtest.Answer("你好")}})
+
+	rec := doChat(t, h, `{"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	assertEvents(t, rec.Body.String(),
+		chunk(`{"role":"assistant"}`, ""),
+		chunk(`{"content":"你好"}`, ""),
+		chunk(`{}`, "error"),
+		`{"error":{"message":"Upstream stream ended before completion","type":"upstream_error","param":null,"code":"upstream_incomplete"}}`,
+		"[DONE]",
+	)
+}
+
+func TestChatNonStream(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript)
+
+	rec := doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	got := normalize(t, rec.Body.String())
+	want := normalize(t, `{"id":"","object":"chat.completion","created":0,"model":"GLM-4.5",
+		"choices":[{"index":0,"message":{"role":"assistant","content":"你好世界","reasoning_content":"想一想"},"delta":{},"finish_reason":"stop"}],
+		"usage":{"prompt_tokens":5,"completion_tokens":7,"total_tokens":12,"completion_tokens_details":{"reasoning_tokens":6}}}`)
+	if got != want {
+		t.Errorf("响应不一致\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestChatNonStreamIncomplete(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Lines: []string{upstreamtest.Answer("你好")}})
+
+	rec := doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	assertErrorCode(t, rec, "upstream_incomplete")
+}
+
+func TestChatRetriesUpstreamStatus(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Status: http.StatusInternalServerError, Body: "boom"}, basicScript)
+
+	rec := doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("X-Upstream-Attempts"); got != "2" {
+		t.Errorf("X-Upstream-Attempts = %q, want 2", got)
+	}
+	if n := len(up.Requests()); n != 2 {
+		t.Errorf("上游请求数 = %d, want 2", n)
+	}
+}
+
+func TestChatUpstreamStatusNotRetried(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Status: http.StatusUnauthorized, Body: `{"detail":"expired"}`})
+
+	rec := doChat(t, h, `{"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	assertErrorCode(t, rec, "upstream_token_expired")
+	if got := rec.Header().Get("X-Upstream-Attempts"); got != "1" {
+		t.Errorf("X-Upstream-Attempts = %q, want 1", got)
+	}
+}
+
+func TestChatAnonymousToken(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(basicScript)
+		doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+
+		if n := up.TokenRequests(); n != 1 {
+			t.Errorf("匿名token请求数 = %d, want 1", n)
+		}
+		if got := up.Requests()[0].Header.Get("Authorization"); got != "Bearer anon-token-1" {
+			t.Errorf("Authorization = %q", got)
+		}
+	})
+	t.Run("fallback", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.TokenStatus = http.StatusServiceUnavailable
+		up.Enqueue(basicScript)
+		doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+
+		if got := up.Requests()[0].Header.Get("Authorization"); got != "Bearer fixed-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+	})
+	t.Run("slow body", func(t *testing.T) {
+		h, up := newTestHandler(t, func(cfg *config.Config) { cfg.Transport.TokenTimeout = config.Duration(50 * time.Millisecond) })
+		up.TokenDelay = 5 * time.Second
+		up.Enqueue(basicScript)
+		start := time.Now()
+		doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("耗时 %s，token_timeout 未生效", d)
+		}
+		if got := up.Requests()[0].Header.Get("Authorization"); got != "Bearer fixed-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		h, up := newTestHandler(t, func(cfg *config.Config) { cfg.AnonTokenEnabled = false })
+		up.Enqueue(basicScript)
+		doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+
+		if n := up.TokenRequests(); n != 0 {
+			t.Errorf("匿名token请求数 = %d, want 0", n)
+		}
+		if got := up.Requests()[0].Header.Get("Authorization"); got != "Bearer fixed-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+	})
+}
+
+func TestChatRequiresKey(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"messages":[]}`))
+	rec := httptest.NewRecorder()
+	h.HandleChatCompletions(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	assertErrorCode(t, rec, "missing_api_key")
+	if n := len(up.Requests()); n != 0 {
+		t.Errorf("上游请求数 = %d, want 0", n)
+	}
+}
+
+func assertErrorCode(t *testing.T, rec *httptest.ResponseRecorder, want string) {
+	t.Helper()
+	var body model.ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("错误响应不是合法JSON: %v\n%s", err, rec.Body)
+	}
+	if body.Error.Code == nil || *body.Error.Code != want {
+		t.Errorf("error.code = %v, want %q (body %s)", body.Error.Code, want, rec.Body)
+	}
+}
+
+func TestChatModelCatalog(t *testing.T) {
+	h, up := newTestHandler(t, func(cfg *config.Config) {
+		cfg.Models = config.ModelCatalog{
+			{ID: "GLM-4.5", Upstream: "0727-360B-API", Features: map[string]interface{}{"enable_thinking": true}},
+			{ID: "glm-fast", Aliases: []string{"fast"}, Upstream: "0727-106B-API", Name: "GLM-4.5-Air",
+				Features: map[string]interface{}{"enable_thinking": false, "web_search": true},
+				Params:   map[string]interface{}{"temperature": 0.2, "top_p": 0.9}},
+		}
+	})
+	up.Enqueue(upstreamtest.Script{Lines: []string{upstreamtest.Answer("好"), upstreamtest.Done(nil)}})
+
+	rec := doChat(t, h, `{"model":"FAST","stream":true,"temperature":0.7,"messages":[{"role":"user","content":"hi"}]}`)
+	events := sseEvents(t, rec.Body.String())
+	if len(events) == 0 || !strings.Contains(events[0], `"model":"FAST"`) {
+		t.Errorf("响应应返回请求的模型名: %v", events)
+	}
+
+	req := up.Requests()[0].Body
+	if req.Model != "0727-106B-API" || req.ModelItem.ID != "0727-106B-API" || req.ModelItem.Name != "GLM-4.5-Air" {
+		t.Errorf("上游模型 = %q, model_item = %+v", req.Model, req.ModelItem)
+	}
+	if !reflect.DeepEqual(req.Features, map[string]interface{}{"enable_thinking": false, "web_search": true}) {
+		t.Errorf("features = %v", req.Features)
+	}
+	if req.Params["top_p"] != 0.9 {
+		t.Errorf("params = %v，应带上模型默认的 top_p", req.Params)
+	}
+}
+
+func TestChatUnknownModel(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+
+	rec := doChat(t, h, `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	assertErrorCode(t, rec, "model_not_found")
+	if n := len(up.Requests()); n != 0 {
+		t.Errorf("上游请求数 = %d, want 0", n)
+	}
+}
+
+func TestModelsList(t *testing.T) {
+	h, _ := newTestHandler(t, nil)
+
+	rec := httptest.NewRecorder()
+	h.HandleModels(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	var resp model.ModelsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, m := range resp.Data {
+		ids = append(ids, m.ID)
+	}
+	var want []string
+	for _, m := range config.Default().Models {
+		want = append(want, m.ID)
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("模型列表 = %v, want %v", ids, want)
+	}
+}
+
+// /readyz 与对话请求并发时不能写共享配置（配合 -race）
+func TestReadyzDuringTraffic(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript, basicScript)
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			doChat(t, h, `{"messages":[{"role":"user","content":"hi"}]}`)
+		}()
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h.HandleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("readyz status = %d, body = %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func decodeJSON(t *testing.T, data []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("响应不是合法JSON: %v\n%s", err, data)
+	}
+}
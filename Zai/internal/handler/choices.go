@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"Zai/internal/model"
+)
+
+// errChoiceDone 该choice的回答已因 stop 或 max_tokens 结束，剩余的上游输出不再需要
+var errChoiceDone = errors.New("choice finished")
+
+// choiceContext 单个choice的上游上下文，派生自请求上下文。回答提前结束时调用 finish
+// 取消上游请求，不必等上游生成完；请求是否被客户端取消仍以请求上下文判断
+type choiceContext struct {
+	context.Context
+	cancel context.CancelCauseFunc
+}
+
+func newChoiceContexts(ctx context.Context, n int) []choiceContext {
+	ccs := make([]choiceContext, n)
+	for i := range ccs {
+		ccs[i].Context, ccs[i].cancel = context.WithCancelCause(ctx)
+	}
+	return ccs
+}
+
+// finish 回答已完整输出，取消上游请求
+func (c choiceContext) finish() {
+	c.cancel(errChoiceDone)
+}
+
+// finished 上游读取是否因 finish 中止，这时的取消错误按正常结束处理
+func (c choiceContext) finished() bool {
+	return errors.Is(context.Cause(c), errChoiceDone)
+}
+
+// cancelAll 请求结束时释放所有choice的上下文
+func cancelAll(ccs []choiceContext) {
+	for _, c := range ccs {
+		c.cancel(nil)
+	}
+}
+
+// openChoices 为 n 个choice并发打开上游对话，每个对话使用各自的 chat_id、token和上下文。
+// 返回的 resps 与 errs 按choice下标一一对应，二者恰有一个非nil；下游已断开时返回 ctx.Err()。
+// 各choice的尝试次数以逗号分隔写入 X-Upstream-Attempts 响应头
+func (h *Handler) openChoices(ctx context.Context, w http.ResponseWriter, ccs []choiceContext, upstreamReqs []model.UpstreamRequest) ([]*http.Response, []*apiError, error) {
+	n := len(upstreamReqs)
+	resps := make([]*http.Response, n)
+	errs := make([]*apiError, n)
+	attempts := make([]string, n)
+
+	var wg sync.WaitGroup
+	for i, req := range upstreamReqs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, tries, err := h.dialUpstream(ccs[i], req)
+			attempts[i] = strconv.Itoa(tries)
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				errs[i] = apiErr
+			} else if err == nil {
+				resps[i] = resp
+			}
+		}()
+	}
+	wg.Wait()
+	w.Header().Set("X-Upstream-Attempts", strings.Join(attempts, ", "))
+
+	if clientGone(ctx) {
+		closeAll(resps)
+		return nil, nil, ctx.Err()
+	}
+	return resps, errs, nil
+}
+
+// closeAll 关闭所有已打开的上游响应
+func closeAll(resps []*http.Response) {
+	for _, resp := range resps {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// firstError 所有choice都失败时返回第一个错误，否则返回nil
+func firstError(errs []*apiError) *apiError {
+	for _, e := range errs {
+		if e == nil {
+			return nil
+		}
+	}
+	return errs[0]
+}
+
+// choiceError n > 1 时随choice返回的错误详情
+func choiceError(e *apiError) *model.ErrorDetail {
+	detail := e.body().Error
+	return &detail
+}
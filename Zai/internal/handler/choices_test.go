@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"Zai/internal/model"
+	"Zai/internal/upstream/upstreamtest"
+)
+
+// 上游并发接收请求，脚本被哪个choice取到不确定，以下断言都不依赖对应关系
+
+var expiredScript = upstreamtest.Script{Status: http.StatusUnauthorized, Body: `{"detail":"expired"}`}
+
+func TestChatNChoicesNonStream(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript, basicScript, basicScript)
+
+	rec := doChat(t, h, `{"n":3,"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var resp model.OpenAIResponse
+	decodeJSON(t, rec.Body.Bytes(), &resp)
+	if len(resp.Choices) != 3 {
+		t.Fatalf("choices = %d, want 3", len(resp.Choices))
+	}
+	for i, c := range resp.Choices {
+		if c.Index != i || c.Message.Content.Text() != "你好世界" || c.FinishReason != "stop" {
+			t.Errorf("choices[%d] = index %d, content %q, finish_reason %q", i, c.Index, c.Message.Content.Text(), c.FinishReason)
+		}
+	}
+	// prompt只计一次，completion相加
+	if u := resp.Usage; u.PromptTokens != 5 || u.CompletionTokens != 21 || u.TotalTokens != 26 || u.CompletionTokensDetails.ReasoningTokens != 18 {
+		t.Errorf("usage = %+v, details = %+v", u, u.CompletionTokensDetails)
+	}
+	if got := rec.Header().Get("X-Upstream-Attempts"); got != "1, 1, 1" {
+		t.Errorf("X-Upstream-Attempts = %q", got)
+	}
+
+	// 每个choice使用独立的对话和匿名token
+	chatIDs, tokens := map[string]bool{}, map[string]bool{}
+	for _, r := range up.Requests() {
+		chatIDs[r.Body.ChatID] = true
+		tokens[r.Header.Get("Authorization")] = true
+	}
+	if len(chatIDs) != 3 || len(tokens) != 3 {
+		t.Errorf("chat_id %d 个, token %d 个, want 各3个", len(chatIDs), len(tokens))
+	}
+}
+
+func TestChatNChoicesStream(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript, basicScript)
+
+	rec := doChat(t, h, `{"n":2,"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	events := sseEvents(t, rec.Body.String())
+	if events[len(events)-1] != "[DONE]" {
+		t.Fatalf("最后一个事件不是 [DONE]: %s", events[len(events)-1])
+	}
+
+	// 按 index 还原每个choice的输出
+	content := make([]strings.Builder, 2)
+	finish := make([]string, 2)
+	var usage *model.Usage
+	for _, e := range events[:len(events)-1] {
+		var c model.OpenAIResponse
+		decodeJSON(t, []byte(e), &c)
+		if c.Usage != nil {
+			usage = c.Usage
+			continue
+		}
+		choice := c.Choices[0]
+		if finish[choice.Index] != "" {
+			t.Errorf("choice %d 结束后仍有输出: %s", choice.Index, e)
+		}
+		content[choice.Index].WriteString(choice.Delta.Content)
+		finish[choice.Index] = choice.FinishReason
+	}
+	for i := range content {
+		if content[i].String() != "你好世界" || finish[i] != "stop" {
+			t.Errorf("choice %d: content %q, finish_reason %q", i, content[i].String(), finish[i])
+		}
+	}
+	if usage == nil || usage.CompletionTokens != 14 || usage.TotalTokens != 19 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestChatNChoicesPartialFailure(t *testing.T) {
+	t.Run("non-stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(basicScript, expiredScript)
+
+		rec := doChat(t, h, `{"n":2,"messages":[{"role":"user","content":"hi"}]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+		var resp model.OpenAIResponse
+		decodeJSON(t, rec.Body.Bytes(), &resp)
+		var ok, failed int
+		for _, c := range resp.Choices {
+			switch {
+			case c.FinishReason == "stop" && c.Error == nil:
+				ok++
+			case c.FinishReason == "error" && c.Error != nil && *c.Error.Code == "upstream_token_expired":
+				failed++
+			default:
+				t.Errorf("choice %d: finish_reason %q, error %+v", c.Index, c.FinishReason, c.Error)
+			}
+		}
+		if ok != 1 || failed != 1 {
+			t.Errorf("成功 %d 个, 失败 %d 个, want 各1个", ok, failed)
+		}
+	})
+	t.Run("stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(basicScript, expiredScript)
+
+		rec := doChat(t, h, `{"n":2,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+		var stopped, failed int
+		for _, e := range sseEvents(t, rec.Body.String()) {
+			if e == "[DONE]" {
+				continue
+			}
+			var c model.OpenAIResponse
+			decodeJSON(t, []byte(e), &c)
+			switch choice := c.Choices[0]; choice.FinishReason {
+			case "stop":
+				stopped++
+			case "error":
+				if choice.Error == nil || *choice.Error.Code != "upstream_token_expired" {
+					t.Errorf("失败choice的错误 = %+v", choice.Error)
+				}
+				failed++
+			}
+		}
+		if stopped != 1 || failed != 1 {
+			t.Errorf("stop %d 个, error %d 个, want 各1个", stopped, failed)
+		}
+	})
+	t.Run("all failed", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(expiredScript, expiredScript)
+
+		rec := doChat(t, h, `{"n":2,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+		assertErrorCode(t, rec, "upstream_token_expired")
+	})
+}
+
+func TestChatNChoicesOutOfRange(t *testing.T) {
+	for _, body := range []string{`{"n":0,"messages":[]}`, `{"n":5,"messages":[]}`} {
+		h, up := newTestHandler(t, nil)
+		rec := doChat(t, h, body)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, body = %s", body, rec.Code, rec.Body)
+		}
+		assertErrorCode(t, rec, "invalid_value")
+		if n := len(up.Requests()); n != 0 {
+			t.Errorf("上游请求数 = %d, want 0", n)
+		}
+	}
+}
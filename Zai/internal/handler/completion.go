@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"Zai/internal/auth"
+	"Zai/internal/config"
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+)
+
+// 以下为各协议端点（OpenAI / Anthropic / ...）共用的鉴权和上游调用步骤，
+// 错误统一以 *apiError 返回，由各端点按自己的协议格式输出。
+
+// apiKeyFromRequest 依次读取 Authorization: Bearer 和 x-api-key
+func apiKeyFromRequest(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return r.Header.Get("x-api-key")
+}
+
+// checkKey 校验下游key
+func (h *Handler) checkKey(r *http.Request) (*auth.Key, *apiError) {
+	return h.checkAPIKey(r.Context(), apiKeyFromRequest(r))
+}
+
+// checkAPIKey 校验已经从请求中取出的key，供读取位置不同的协议使用
+func (h *Handler) checkAPIKey(ctx context.Context, apiKey string) (*auth.Key, *apiError) {
+	if apiKey == "" {
+		slog.DebugContext(ctx, "缺少API key")
+		return nil, &apiError{Status: http.StatusUnauthorized, Type: errTypeAuthentication, Code: "missing_api_key", Message: "Missing API key"}
+	}
+
+	key, err := h.keys.Authenticate(apiKey)
+	switch {
+	case errors.Is(err, auth.ErrKeyDisabled):
+		slog.DebugContext(ctx, "API key已停用", "key", key.Name)
+		return nil, &apiError{Status: http.StatusUnauthorized, Type: errTypeAuthentication, Code: "api_key_disabled", Message: "API key disabled"}
+	case errors.Is(err, auth.ErrKeyExpired):
+		slog.DebugContext(ctx, "API key已过期", "key", key.Name)
+		return nil, &apiError{Status: http.StatusUnauthorized, Type: errTypeAuthentication, Code: "api_key_expired", Message: "API key expired"}
+	case err != nil:
+		slog.DebugContext(ctx, "无效的API key")
+		return nil, &apiError{Status: http.StatusUnauthorized, Type: errTypeAuthentication, Code: "invalid_api_key", Message: "Invalid API key"}
+	}
+
+	slog.DebugContext(ctx, "API key验证通过", "key", key.Name)
+	return key, nil
+}
+
+// checkModel 在模型目录中查找模型（ID或别名），并校验key是否可以调用。
+// key 的 models 列表写ID或任一别名都可以
+func (h *Handler) checkModel(ctx context.Context, key *auth.Key, modelName string) (*config.ModelConfig, *apiError) {
+	m, ok := h.cfg.Models.Find(modelName)
+	if !ok {
+		// 未知模型不计入标签，避免任意模型名导致指标基数失控
+		metrics.SetLabels(ctx, key.Name, "")
+		slog.DebugContext(ctx, "模型不存在", "model", modelName)
+		return nil, &apiError{Status: http.StatusNotFound, Type: errTypeNotFound, Code: "model_not_found", Param: "model",
+			Message: fmt.Sprintf("The model %q does not exist", modelName)}
+	}
+	metrics.SetLabels(ctx, key.Name, m.ID)
+	for _, n := range m.Names() {
+		if key.AllowsModel(n) {
+			return m, nil
+		}
+	}
+	slog.DebugContext(ctx, "key无权调用该模型", "model", modelName)
+	return nil, &apiError{Status: http.StatusForbidden, Type: errTypePermission, Code: "model_not_allowed", Param: "model",
+		Message: fmt.Sprintf("Model %q is not allowed for this API key", modelName)}
+}
+
+// errImageUnsupported 上游只接受纯文本
+var errImageUnsupported = &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Code: "unsupported_content", Param: "messages",
+	Message: "Image input is not supported by this upstream"}
+
+// newUpstreamRequest 构造上游请求。params 在模型的默认 params 之上覆盖，features 取模型配置
+func (h *Handler) newUpstreamRequest(m *config.ModelConfig, messages []model.UpstreamMessage, params map[string]interface{}) model.UpstreamRequest {
+	// 生成会话相关ID
+	chatID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().Unix())
+	msgID := fmt.Sprintf("%d", time.Now().UnixNano())
+	merged := maps.Clone(m.Params)
+	if merged == nil {
+		merged = map[string]interface{}{}
+	}
+	maps.Copy(merged, params)
+
+	return model.UpstreamRequest{
+		Stream:   true, // 总是使用流式从上游获取
+		ChatID:   chatID,
+		ID:       msgID,
+		Model:    m.Upstream, // 上游实际模型ID
+		Messages: messages,
+		Params:   merged,
+		Features: maps.Clone(m.Features),
+		BackgroundTasks: map[string]bool{
+			"title_generation": false,
+			"tags_generation":  false,
+		},
+		MCPServers: []string{},
+		ModelItem: struct {
+			ID      string `json:"id"`
+			Name    string `json:"name"`
+			OwnedBy string `json:"owned_by"`
+		}{ID: m.Upstream, Name: m.Name, OwnedBy: "openai"},
+		ToolServers: []string{},
+		Variables: map[string]string{
+			"{{USER_NAME}}":        "User",
+			"{{USER_LOCATION}}":    "Unknown",
+			"{{CURRENT_DATETIME}}": time.Now().Format("2006-01-02 15:04:05"),
+		},
+	}
+}
+
+// openUpstream 调用上游（含重试）并检查状态码。下游已断开时返回 ctx.Err()，
+// 其他失败（含服务关闭）返回 *apiError；成功时调用方负责关闭响应体。
+// 尝试次数写入 X-Upstream-Attempts 响应头
+func (h *Handler) openUpstream(ctx context.Context, w http.ResponseWriter, upstreamReq model.UpstreamRequest) (*http.Response, error) {
+	resp, attempts, err := h.dialUpstream(ctx, upstreamReq)
+	w.Header().Set("X-Upstream-Attempts", strconv.Itoa(attempts))
+	return resp, err
+}
+
+// dialUpstream 与 openUpstream 相同，但不写响应头，尝试次数由调用方处理。
+// 多个上游对话并发时使用，避免同时修改响应头
+func (h *Handler) dialUpstream(ctx context.Context, upstreamReq model.UpstreamRequest) (*http.Response, int, error) {
+	chatID := upstreamReq.ChatID
+	resp, attempts, err := h.callUpstream(ctx, upstreamReq, chatID)
+	if clientGone(ctx) {
+		logCanceled(ctx, chatID, "上游响应前")
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, attempts, ctx.Err()
+	}
+	if shuttingDown(ctx) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, attempts, errShuttingDown
+	}
+	if err != nil {
+		slog.DebugContext(ctx, "调用上游失败", "chat_id", chatID, "error", err)
+		return nil, attempts, h.upstreamCallError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		slog.DebugContext(ctx, "上游返回错误状态", "chat_id", chatID, "status", resp.StatusCode)
+		defer resp.Body.Close()
+		return nil, attempts, h.upstreamStatusError(resp)
+	}
+	return resp, attempts, nil
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"Zai/internal/model"
+	"Zai/internal/upstream"
+)
+
+// OpenAI 错误类型
+const (
+	errTypeInvalidRequest = "invalid_request_error"
+	errTypeAuthentication = "authentication_error"
+	errTypePermission     = "permission_error"
+	errTypeNotFound       = "not_found_error"
+	errTypeRateLimit      = "rate_limit_exceeded"
+	errTypeUpstream       = "upstream_error"
+	errTypeServer         = "server_error"
+)
+
+// apiError 返回给下游的错误，序列化为 {"error":{"message","type","code","param"}}
+type apiError struct {
+	Status  int
+	Type    string
+	Code    string
+	Param   string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Type, e.Message)
+}
+
+func (e *apiError) body() model.ErrorResponse {
+	detail := model.ErrorDetail{Message: e.Message, Type: e.Type}
+	if e.Code != "" {
+		detail.Code = &e.Code
+	}
+	if e.Param != "" {
+		detail.Param = &e.Param
+	}
+	return model.ErrorResponse{Error: detail}
+}
+
+func writeAPIError(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e.body())
+}
+
+// writeError 直接写出一个下游错误
+func writeError(w http.ResponseWriter, status int, errType, code, param, message string) {
+	writeAPIError(w, &apiError{Status: status, Type: errType, Code: code, Param: param, Message: message})
+}
+
+// upstreamDetail 上游的原始错误文本只在debug模式下透传
+func (h *Handler) upstreamDetail(message, detail string) string {
+	if h.cfg.DebugMode && detail != "" {
+		return message + ": " + detail
+	}
+	return message
+}
+
+// upstreamCallError 上游请求未拿到响应（连接失败、超时等）
+func (h *Handler) upstreamCallError(err error) *apiError {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, upstream.ErrStreamIdle) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &apiError{Status: http.StatusGatewayTimeout, Type: errTypeUpstream, Code: "upstream_timeout",
+			Message: h.upstreamDetail("Upstream request timed out", err.Error())}
+	}
+	return &apiError{Status: http.StatusBadGateway, Type: errTypeUpstream, Code: "upstream_unavailable",
+		Message: h.upstreamDetail("Failed to connect to upstream", err.Error())}
+}
+
+// upstreamStatusError 上游返回非200状态，读取错误体用于debug
+func (h *Handler) upstreamStatusError(resp *http.Response) *apiError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	slog.DebugContext(resp.Request.Context(), "上游错误响应", "status", resp.StatusCode, "body", string(body))
+	return h.mapUpstreamCode(resp.StatusCode, string(body))
+}
+
+// upstreamEventError SSE事件中携带的上游错误
+func (h *Handler) upstreamEventError(e *model.UpstreamError) *apiError {
+	return h.mapUpstreamCode(e.Code, e.Detail)
+}
+
+// mapUpstreamCode 把上游状态码/错误码映射为下游错误
+func (h *Handler) mapUpstreamCode(code int, detail string) *apiError {
+	switch {
+	case code == http.StatusUnauthorized:
+		return &apiError{Status: http.StatusUnauthorized, Type: errTypeAuthentication, Code: "upstream_token_expired",
+			Message: h.upstreamDetail("Upstream token is invalid or expired", detail)}
+	case code == http.StatusForbidden:
+		return &apiError{Status: http.StatusForbidden, Type: errTypePermission, Code: "upstream_forbidden",
+			Message: h.upstreamDetail("Upstream refused the request", detail)}
+	case code == http.StatusTooManyRequests:
+		return &apiError{Status: http.StatusTooManyRequests, Type: errTypeRateLimit, Code: "rate_limit_exceeded",
+			Message: h.upstreamDetail("Upstream rate limit exceeded", detail)}
+	case code == http.StatusBadRequest || code == http.StatusRequestEntityTooLarge:
+		return &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Code: "upstream_rejected",
+			Message: h.upstreamDetail("Upstream rejected the request", detail)}
+	case code == http.StatusGatewayTimeout:
+		return &apiError{Status: http.StatusGatewayTimeout, Type: errTypeUpstream, Code: "upstream_timeout",
+			Message: h.upstreamDetail("Upstream request timed out", detail)}
+	default:
+		return &apiError{Status: http.StatusBadGateway, Type: errTypeUpstream, Code: "upstream_error",
+			Message: h.upstreamDetail(fmt.Sprintf("Upstream error (code %d)", code), detail)}
+	}
+}
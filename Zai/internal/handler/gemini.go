@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"Zai/internal/auth"
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+	"Zai/internal/responses"
+	"Zai/internal/util"
+)
+
+const geminiModelsPath = "/v1beta/models/"
+
+// HandleGemini Gemini REST 接口：
+// POST /v1beta/models/{model}:generateContent 与 :streamGenerateContent
+func (h *Handler) HandleGemini(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Gemini 的key放在 x-goog-api-key 头或 ?key= 参数中，也兼容 Bearer
+	apiKey := r.Header.Get("x-goog-api-key")
+	if apiKey == "" {
+		apiKey = r.URL.Query().Get("key")
+	}
+	if apiKey == "" {
+		apiKey = apiKeyFromRequest(r)
+	}
+	key, apiErr := h.checkAPIKey(r.Context(), apiKey)
+	if apiErr != nil {
+		writeGeminiError(w, apiErr)
+		return
+	}
+	ctx := auth.WithKey(r.Context(), key)
+
+	modelName, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, geminiModelsPath), ":")
+	if r.Method != http.MethodPost || (method != "generateContent" && method != "streamGenerateContent") {
+		writeGeminiError(w, &apiError{Status: http.StatusNotFound, Type: errTypeNotFound,
+			Message: fmt.Sprintf("Method %s %s is not supported", r.Method, r.URL.Path)})
+		return
+	}
+	modelCfg, apiErr := h.checkModel(ctx, key, modelName)
+	if apiErr != nil {
+		writeGeminiError(w, apiErr)
+		return
+	}
+
+	var req model.GeminiRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.DebugContext(ctx, "JSON解析失败", "error", err)
+		writeGeminiError(w, &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: "Invalid JSON payload: " + err.Error()})
+		return
+	}
+	badRequest := func(msg string) {
+		writeGeminiError(w, &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Message: msg})
+	}
+	if len(req.Contents) == 0 {
+		badRequest("contents is not specified")
+		return
+	}
+	if len(req.Tools) > 0 && string(req.Tools) != "null" && string(req.Tools) != "[]" {
+		badRequest("Function calling is not supported by this proxy")
+		return
+	}
+
+	messages := make([]model.UpstreamMessage, 0, len(req.Contents)+1)
+	if req.SystemInstruction != nil {
+		if system := req.SystemInstruction.Text(); system != "" {
+			messages = append(messages, model.UpstreamMessage{Role: "system", Content: system})
+		}
+	}
+	for _, c := range req.Contents {
+		if c.HasMedia() {
+			badRequest(errImageUnsupported.Message)
+			return
+		}
+		if c.HasFunctionParts() {
+			badRequest("Function calling is not supported by this proxy")
+			return
+		}
+		role := "user"
+		if c.Role == "model" {
+			role = "assistant"
+		}
+		messages = append(messages, model.UpstreamMessage{Role: role, Content: c.Text()})
+	}
+
+	params := map[string]interface{}{}
+	includeThoughts := false // 与 Gemini API 一致，只有 includeThoughts 为 true 时才返回思考部分
+	var stops []string
+	maxTokens := 0
+	if gc := req.GenerationConfig; gc != nil {
+		if gc.MaxOutputTokens != nil {
+			params["max_tokens"] = *gc.MaxOutputTokens
+			maxTokens = *gc.MaxOutputTokens
+		}
+		if gc.Temperature != nil {
+			params["temperature"] = *gc.Temperature
+		}
+		if gc.TopP != nil {
+			params["top_p"] = *gc.TopP
+		}
+		if gc.TopK != nil {
+			params["top_k"] = *gc.TopK
+		}
+		if len(gc.StopSequences) > 0 {
+			stops = gc.StopSequences
+			params["stop"] = stops
+		}
+		if tc := gc.ThinkingConfig; tc != nil && tc.IncludeThoughts != nil {
+			includeThoughts = *tc.IncludeThoughts
+		}
+	}
+
+	stream := method == "streamGenerateContent"
+	sse := r.URL.Query().Get("alt") == "sse"
+	upstreamReq := h.newUpstreamRequest(modelCfg, messages, params)
+	slog.InfoContext(ctx, "gemini", "method", method, "model", modelName, "sse", sse, "chat_id", upstreamReq.ChatID)
+
+	// 上游可能忽略 stopSequences 和 maxOutputTokens，由代理在回答上再执行一次，截断后立即取消上游请求
+	cc := newChoiceContexts(ctx, 1)[0]
+	defer cc.cancel(nil)
+	resp, err := h.openUpstream(cc, w, upstreamReq)
+	if errors.As(err, &apiErr) {
+		writeGeminiError(w, apiErr)
+		return
+	} else if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	responseID := responses.NewID("gen")
+	newResponse := func(parts []model.GeminiPart) *model.GeminiResponse {
+		return &model.GeminiResponse{
+			Candidates:   []model.GeminiCandidate{{Content: model.GeminiContent{Role: "model", Parts: parts}}},
+			ModelVersion: modelName,
+			ResponseID:   responseID,
+		}
+	}
+
+	var gs *geminiStream
+	if stream {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeGeminiError(w, &apiError{Status: http.StatusInternalServerError, Type: errTypeServer, Message: "Streaming unsupported"})
+			return
+		}
+		gs = &geminiStream{w: w, flusher: flusher, sse: sse}
+		metrics.MarkStream(ctx)
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+	}
+
+	// 非流式时相邻的同类部分合并，思考在前、回答在后
+	var parts []model.GeminiPart
+	emit := func(part model.GeminiPart) {
+		if stream {
+			gs.write(newResponse([]model.GeminiPart{part}))
+			return
+		}
+		if n := len(parts); n > 0 && parts[n-1].Thought == part.Thought {
+			parts[n-1].Text += part.Text
+			return
+		}
+		parts = append(parts, part)
+	}
+
+	answer := newAnswerFilter(cc, stops, maxTokens)
+	think := newThinkFilter("strip")
+	emitThought := func(t string) {
+		if t != "" {
+			emit(model.GeminiPart{Text: t, Thought: true})
+		}
+	}
+	var usage usageTracker
+	err = h.readUpstream(cc, resp.Body, upstreamReq.ChatID, func(data *model.UpstreamData) {
+		usage.observe(data)
+		if data.Data.DeltaContent == "" {
+			return
+		}
+		if data.Data.Phase == "thinking" {
+			if !includeThoughts {
+				return
+			}
+			emitThought(think.Feed(data.Data.DeltaContent))
+			return
+		}
+		emitThought(think.Flush())
+		if t := answer.Feed(data.Data.DeltaContent); t != "" {
+			emit(model.GeminiPart{Text: t})
+		}
+	})
+	err = answer.result(err)
+	if clientGone(ctx) {
+		logCanceled(ctx, upstreamReq.ChatID, "gemini")
+		return
+	}
+	if errors.As(err, &apiErr) {
+		if !stream {
+			writeGeminiError(w, apiErr)
+			return
+		}
+		gs.write(geminiErrorBody(apiErr))
+		gs.close()
+		return
+	}
+	emitThought(think.Flush())
+	if t := answer.Flush(); t != "" {
+		emit(model.GeminiPart{Text: t})
+	}
+
+	u := usage.usage()
+	logUsage(ctx, upstreamReq.ChatID, u)
+	reasoning := u.CompletionTokensDetails.ReasoningTokens
+	usageMeta := &model.GeminiUsage{
+		PromptTokenCount:     u.PromptTokens,
+		CandidatesTokenCount: u.CompletionTokens - reasoning,
+		ThoughtsTokenCount:   reasoning,
+		TotalTokenCount:      u.TotalTokens,
+	}
+
+	// 最后一块带 finishReason 和 usageMetadata，因 maxOutputTokens 截断时为 MAX_TOKENS
+	finishReason := "STOP"
+	if answer.Reached() {
+		finishReason = "MAX_TOKENS"
+	}
+	if stream {
+		final := newResponse([]model.GeminiPart{{Text: ""}})
+		final.Candidates[0].FinishReason = finishReason
+		final.UsageMetadata = usageMeta
+		gs.write(final)
+		gs.close()
+		return
+	}
+	if parts == nil {
+		parts = []model.GeminiPart{{Text: ""}}
+	}
+	final := newResponse(parts)
+	final.Candidates[0].FinishReason = finishReason
+	final.UsageMetadata = usageMeta
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(final)
+}
+
+// geminiStream 流式输出：alt=sse 时为 SSE，否则与官方一致输出逐步写入的 JSON 数组
+type geminiStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+	n       int
+}
+
+func (s *geminiStream) write(v interface{}) {
+	data, _ := json.Marshal(v)
+	switch {
+	case s.sse:
+		fmt.Fprintf(s.w, "data: %s\r\n\r\n", data)
+	case s.n == 0:
+		fmt.Fprintf(s.w, "[%s", data)
+	default:
+		fmt.Fprintf(s.w, ",\r\n%s", data)
+	}
+	s.n++
+	s.flusher.Flush()
+}
+
+func (s *geminiStream) close() {
+	if !s.sse {
+		if s.n == 0 {
+			fmt.Fprint(s.w, "[")
+		}
+		fmt.Fprint(s.w, "]")
+	}
+	s.flusher.Flush()
+}
+
+// geminiStatus 按HTTP状态码给出 Google API 的错误状态名
+func geminiStatus(code int) string {
+	switch code {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	default:
+		return "INTERNAL"
+	}
+}
+
+func geminiErrorBody(e *apiError) model.GeminiErrorResponse {
+	return model.GeminiErrorResponse{Error: model.GeminiError{Code: e.Status, Message: e.Message, Status: geminiStatus(e.Status)}}
+}
+
+// writeGeminiError Gemini 的错误格式：{"error":{"code","message","status"}}
+func writeGeminiError(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(geminiErrorBody(e))
+}
@@ -1,191 +1,247 @@
 package handler
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"Zai/internal/auth"
 	"Zai/internal/config"
+	"Zai/internal/logging"
+	"Zai/internal/metrics"
 	"Zai/internal/model"
+	"Zai/internal/responses"
+	"Zai/internal/tools"
 	"Zai/internal/upstream"
 	"Zai/internal/util"
 )
 
-func HandleOptions(w http.ResponseWriter, r *http.Request) {
+// Handler 持有运行时配置和上游客户端
+type Handler struct {
+	cfg       *config.Config
+	keys      *auth.Store
+	upstream  *upstream.Client
+	responses *responses.Store
+	started   time.Time
+	probe     upstreamProbe
+	configErr error // 启动时的配置校验结果，/readyz 直接返回，不在请求中重新校验
+}
+
+func New(cfg *config.Config) (*Handler, error) {
+	keys, err := auth.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{
+		cfg:       cfg,
+		keys:      keys,
+		upstream:  upstream.NewClient(cfg),
+		responses: responses.NewStore(cfg.ResponseStore),
+		started:   time.Now(),
+		configErr: cfg.Validate(),
+	}, nil
+}
+
+// authenticate 校验下游key，失败时直接写回OpenAI格式的错误
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*auth.Key, bool) {
+	key, apiErr := h.checkKey(r)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return nil, false
+	}
+	return key, true
+}
+
+func (h *Handler) HandleOptions(w http.ResponseWriter, r *http.Request) {
 	util.SetCORSHeaders(w)
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	w.WriteHeader(http.StatusNotFound)
+	writeError(w, http.StatusNotFound, errTypeNotFound, "not_found", "", fmt.Sprintf("Unknown endpoint: %s %s", r.Method, r.URL.Path))
 }
 
-func HandleModels(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleModels(w http.ResponseWriter, r *http.Request) {
 	util.SetCORSHeaders(w)
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	response := model.ModelsResponse{
-		Object: "list",
-		Data: []model.Model{
-			{
-				ID:      config.MODEL_NAME,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "z.ai",
-			},
-		},
+	response := model.ModelsResponse{Object: "list", Data: []model.Model{}}
+	for _, m := range h.cfg.Models {
+		response.Data = append(response.Data, model.Model{
+			ID:      m.ID,
+			Object:  "model",
+			Created: h.started.Unix(),
+			OwnedBy: "z.ai",
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	util.SetCORSHeaders(w)
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	util.DebugLog("收到chat completions请求")
+	slog.DebugContext(r.Context(), "收到chat completions请求")
 
 	// 验证API Key
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		util.DebugLog("缺少或无效的Authorization头")
-		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-		return
-	}
-
-	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if apiKey != config.DEFAULT_KEY {
-		util.DebugLog("无效的API key: %s", apiKey)
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+	key, ok := h.authenticate(w, r)
+	if !ok {
 		return
 	}
-
-	util.DebugLog("API key验证通过")
+	ctx := auth.WithKey(r.Context(), key)
 
 	// 解析请求
 	var req model.OpenAIRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		util.DebugLog("JSON解析失败: %v", err)
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		slog.DebugContext(ctx, "JSON解析失败", "error", err)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "invalid_json", "", "Invalid JSON body: "+err.Error())
 		return
 	}
 
-	util.DebugLog("请求解析成功 - 模型: %s, 流式: %v, 消息数: %d", req.Model, req.Stream, len(req.Messages))
-
-	// 生成会话相关ID
-	chatID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().Unix())
-	msgID := fmt.Sprintf("%d", time.Now().UnixNano())
+	slog.DebugContext(ctx, "请求解析成功", "model", req.Model, "stream", req.Stream, "messages", len(req.Messages))
 
-	// 构造上游请求
-	upstreamReq := model.UpstreamRequest{
-		Stream:   true, // 总是使用流式从上游获取
-		ChatID:   chatID,
-		ID:       msgID,
-		Model:    "0727-360B-API", // 上游实际模型ID
-		Messages: req.Messages,
-		Params:   map[string]interface{}{},
-		Features: map[string]interface{}{
-			"enable_thinking": true,
-		},
-		BackgroundTasks: map[string]bool{
-			"title_generation": false,
-			"tags_generation":  false,
-		},
-		MCPServers: []string{},
-		ModelItem: struct {
-			ID      string `json:"id"`
-			Name    string `json:"name"`
-			OwnedBy string `json:"owned_by"`
-		}{ID: "0727-360B-API", Name: "GLM-4.5", OwnedBy: "openai"},
-		ToolServers: []string{},
-		Variables: map[string]string{
-			"{{USER_NAME}}":        "User",
-			"{{USER_LOCATION}}":    "Unknown",
-			"{{CURRENT_DATETIME}}": time.Now().Format("2006-01-02 15:04:05"),
-		},
+	if req.Model == "" {
+		req.Model = h.cfg.ModelName
+	}
+	modelCfg, apiErr := h.checkModel(ctx, key, req.Model)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
 	}
 
-	// 选择本次对话使用的token
-	authToken := config.UPSTREAM_TOKEN
-	if config.ANON_TOKEN_ENABLED {
-		if t, err := upstream.GetAnonymousToken(); err == nil {
-			authToken = t
-			util.DebugLog("匿名token获取成功: %s...", func() string {
-				if len(t) > 10 {
-					return t[:10]
-				}
-				return t
-			}())
-		} else {
-			util.DebugLog("匿名token获取失败，回退固定token: %v", err)
+	// 上游只接受纯文本，图片输入直接拒绝
+	for _, m := range req.Messages {
+		if len(m.Content.Images()) > 0 {
+			slog.DebugContext(ctx, "请求包含图片，上游不支持")
+			writeAPIError(w, errImageUnsupported)
+			return
 		}
 	}
 
+	toolChoice, err := tools.ParseChoice(req.ToolChoice, req.Tools)
+	if err != nil {
+		slog.DebugContext(ctx, "tool_choice解析失败", "error", err)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "invalid_value", "tool_choice", "Invalid tool_choice: "+err.Error())
+		return
+	}
+	thinkMode, err := h.thinkModeFor(r, &req)
+	if err != nil {
+		slog.DebugContext(ctx, "思考输出方式无效", "error", err)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "invalid_value", "reasoning_mode", err.Error())
+		return
+	}
+	params, maxTokens, apiErr := chatParams(&req)
+	if apiErr != nil {
+		slog.DebugContext(ctx, "采样参数无效", "param", apiErr.Param)
+		writeAPIError(w, apiErr)
+		return
+	}
+	n := 1
+	if req.N != nil {
+		n = *req.N
+	}
+	if n < 1 || n > h.cfg.MaxChoices {
+		slog.DebugContext(ctx, "n超出范围", "n", n, "max_choices", h.cfg.MaxChoices)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "invalid_value", "n", fmt.Sprintf("n must be between 1 and %d", h.cfg.MaxChoices))
+		return
+	}
+	opts := chatOptions{
+		model:     req.Model,
+		n:         n,
+		tools:     tools.Active(req.Tools, toolChoice),
+		thinkMode: thinkMode,
+		stops:     req.Stop,
+		maxTokens: maxTokens,
+	}
+	if req.StreamOptions != nil {
+		opts.includeUsage = req.StreamOptions.IncludeUsage
+	}
+
+	// n 个choice各自对应一个上游对话（独立的 chat_id 和token）
+	messages := tools.PrepareMessages(req.Messages, req.Tools, toolChoice)
+	upstreamReqs := make([]model.UpstreamRequest, opts.n)
+	chatIDs := make([]string, opts.n)
+	for i := range upstreamReqs {
+		upstreamReqs[i] = h.newUpstreamRequest(modelCfg, messages, params)
+		chatIDs[i] = upstreamReqs[i].ChatID
+	}
+
 	// 调用上游API
+	slog.InfoContext(ctx, "chat completion", "model", req.Model, "stream", req.Stream, "n", opts.n, "chat_id", strings.Join(chatIDs, ","))
 	if req.Stream {
-		handleStreamResponseWithIDs(w, upstreamReq, chatID, authToken)
+		h.handleStreamResponseWithIDs(ctx, w, upstreamReqs, opts)
 	} else {
-		handleNonStreamResponseWithIDs(w, upstreamReq, chatID, authToken)
+		h.handleNonStreamResponseWithIDs(ctx, w, upstreamReqs, opts)
 	}
 }
 
-func handleStreamResponseWithIDs(w http.ResponseWriter, upstreamReq model.UpstreamRequest, chatID string, authToken string) {
-	util.DebugLog("开始处理流式响应 (chat_id=%s)", chatID)
+// chatOptions 单次请求的输出选项
+type chatOptions struct {
+	model        string // 响应中返回的模型名，与请求一致
+	tools        bool   // 解析模型输出中的工具调用
+	includeUsage bool   // 流式结束前发送usage chunk
+	n            int    // choice数，每个choice并发调用一次上游
+	thinkMode    string // 思考内容输出方式，见 config.ThinkModes
+
+	// 上游可能忽略 stop 和 max_tokens，由代理在回答上再执行一次
+	stops     []string
+	maxTokens int // 0 表示不限制
+}
 
-	resp, err := upstream.CallUpstreamWithHeaders(upstreamReq, chatID, authToken)
-	if err != nil {
-		util.DebugLog("调用上游失败: %v", err)
-		http.Error(w, "Failed to call upstream", http.StatusBadGateway)
-		return
+// thinkModeFor 按 X-Reasoning-Mode 头 > 请求体 reasoning_mode > 配置 的优先级确定思考内容输出方式
+func (h *Handler) thinkModeFor(r *http.Request, req *model.OpenAIRequest) (string, error) {
+	mode := r.Header.Get("X-Reasoning-Mode")
+	if mode == "" {
+		mode = req.ReasoningMode
+	}
+	if mode == "" {
+		return h.cfg.ThinkTagsMode, nil
+	}
+	if !config.ValidThinkMode(mode) {
+		return "", fmt.Errorf("unsupported reasoning mode %q", mode)
+	}
+	return mode, nil
+}
+
+// thinkFilterMode thinkFilter 使用的标签处理方式：reasoning 输出纯文本，与 strip 相同
+func (o chatOptions) thinkFilterMode() string {
+	if o.thinkMode == "reasoning" {
+		return "strip"
 	}
-	defer resp.Body.Close()
+	return o.thinkMode
+}
 
-	if resp.StatusCode != http.StatusOK {
-		util.DebugLog("上游返回错误状态: %d", resp.StatusCode)
-		// 读取错误响应体
-		if config.DEBUG_MODE {
-			body, _ := io.ReadAll(resp.Body)
-			util.DebugLog("上游错误响应: %s", string(body))
-		}
-		http.Error(w, "Upstream error", http.StatusBadGateway)
+func (h *Handler) handleStreamResponseWithIDs(ctx context.Context, w http.ResponseWriter, upstreamReqs []model.UpstreamRequest, opts chatOptions) {
+	slog.DebugContext(ctx, "开始处理流式响应", "chat_id", upstreamReqs[0].ChatID, "n", len(upstreamReqs))
+
+	ccs := newChoiceContexts(ctx, len(upstreamReqs))
+	defer cancelAll(ccs)
+	resps, errs, err := h.openChoices(ctx, w, ccs, upstreamReqs)
+	if err != nil {
 		return
 	}
-
-	// 用于策略2：总是展示thinking（配合标签处理）
-	transformThinking := func(s string) string {
-		// 去 <summary>…</summary>
-		s = regexp.MustCompile(`(?s)<summary>.*?</summary>`).ReplaceAllString(s, "")
-		// 清理残留自定义标签，如 </thinking>、<Full> 等
-		s = strings.ReplaceAll(s, "</thinking>", "")
-		s = strings.ReplaceAll(s, "<Full>", "")
-		s = strings.ReplaceAll(s, "</Full>", "")
-		s = strings.TrimSpace(s)
-		switch config.THINK_TAGS_MODE {
-		case "think":
-			s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "<think>")
-			s = strings.ReplaceAll(s, "</details>", "</think>")
-		case "strip":
-			s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "")
-			s = strings.ReplaceAll(s, "</details>", "")
-		}
-		// 处理每行前缀 "> "（包括起始位置）
-		s = strings.TrimPrefix(s, "> ")
-		s = strings.ReplaceAll(s, "\n> ", "\n")
-		return strings.TrimSpace(s)
+	defer closeAll(resps)
+	// 所有choice都打开失败时直接返回HTTP错误
+	if apiErr := firstError(errs); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
 	}
 
+	metrics.MarkStream(ctx)
 	// 设置SSE头部
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -193,246 +249,341 @@ func handleStreamResponseWithIDs(w http.ResponseWriter, upstreamReq model.Upstre
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errTypeServer, "streaming_unsupported", "", "Streaming unsupported")
 		return
 	}
 
-	// 发送第一个chunk（role）
-	firstChunk := model.OpenAIResponse{
-		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   config.MODEL_NAME,
-		Choices: []model.Choice{
-			{
-				Index: 0,
-				Delta: model.Delta{Role: "assistant"},
-			},
-		},
+	// 多个choice并发输出，写出时加锁，各choice的chunk按到达顺序交错
+	var mu sync.Mutex
+	send := func(choices []model.Choice, usage *model.Usage) {
+		mu.Lock()
+		defer mu.Unlock()
+		writeSSEChunk(w, model.OpenAIResponse{
+			ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   opts.model,
+			Choices: choices,
+			Usage:   usage,
+		})
+		flusher.Flush()
 	}
-	writeSSEChunk(w, firstChunk)
-	flusher.Flush()
-
-	// 读取上游SSE流
-	util.DebugLog("开始读取上游SSE流")
-	scanner := bufio.NewScanner(resp.Body)
-	lineCount := 0
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		lineCount++
-
-		if !strings.HasPrefix(line, "data: ") {
-			continue
+	// 每个choice先发送第一个chunk（role），打开失败的choice随即结束
+	for i := range resps {
+		send([]model.Choice{{Index: i, Delta: model.Delta{Role: "assistant"}}}, nil)
+		if errs[i] != nil {
+			send([]model.Choice{{Index: i, FinishReason: "error", Error: choiceError(errs[i])}}, nil)
 		}
+	}
 
-		dataStr := strings.TrimPrefix(line, "data: ")
-		if dataStr == "" {
+	usages := make([]*model.Usage, len(resps))
+	failures := make([]*apiError, len(resps))
+	var wg sync.WaitGroup
+	for i, resp := range resps {
+		if resp == nil {
 			continue
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			usages[i], failures[i] = h.streamChoice(ctx, ccs[i], resp, upstreamReqs[i].ChatID, i, opts, send)
+		}()
+	}
+	wg.Wait()
+	if clientGone(ctx) {
+		logCanceled(ctx, upstreamReqs[0].ChatID, "流式转发中")
+		return
+	}
+
+	// stream_options.include_usage：choices为空的usage chunk
+	if opts.includeUsage {
+		send([]model.Choice{}, mergeUsage(usages))
+	}
+	// 只有一个choice时上游中途出错随后发送错误事件，多个choice时错误已随各自的结束chunk返回
+	if opts.n == 1 && failures[0] != nil {
+		writeSSEError(w, failures[0])
+	}
 
-		util.DebugLog("收到SSE数据 (第%d行): %s", lineCount, dataStr)
+	// 发送[DONE]
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+	slog.DebugContext(ctx, "流式响应完成")
+}
 
-		var upstreamData model.UpstreamData
-		if err := json.Unmarshal([]byte(dataStr), &upstreamData); err != nil {
-			util.DebugLog("SSE数据解析失败: %v", err)
-			continue
+// streamChoice 转发一个choice的上游流并发送它的结束chunk，返回usage和上游中途的错误。
+// 回答命中 stop 或达到 max_tokens 后立即取消该choice的上游请求并结束。下游断开时不发送结束chunk
+func (h *Handler) streamChoice(ctx context.Context, cc choiceContext, resp *http.Response, chatID string, index int, opts chatOptions, send func([]model.Choice, *model.Usage)) (*model.Usage, *apiError) {
+	sendDelta := func(delta model.Delta) {
+		send([]model.Choice{{Index: index, Delta: delta}}, nil)
+	}
+
+	// 工具调用按出现顺序编号，每个调用一次性发送完整参数
+	parser := tools.NewParser()
+	toolIndex := 0
+	sendToolCalls := func(calls []model.ToolCall) {
+		for _, tc := range calls {
+			idx := toolIndex
+			toolIndex++
+			tc.Index = &idx
+			logging.Content(ctx, "发送工具调用", "name", tc.Function.Name, "arguments", tc.Function.Arguments)
+			sendDelta(model.Delta{ToolCalls: []model.ToolCall{tc}})
 		}
+	}
 
-		// 错误检测（data.error 或 data.data.error 或 顶层error）
-		if (upstreamData.Error != nil) || (upstreamData.Data.Error != nil) || (upstreamData.Data.Inner != nil && upstreamData.Data.Inner.Error != nil) {
-			errObj := upstreamData.Error
-			if errObj == nil {
-				errObj = upstreamData.Data.Error
-			}
-			if errObj == nil && upstreamData.Data.Inner != nil {
-				errObj = upstreamData.Data.Inner.Error
-			}
-			util.DebugLog("上游错误: code=%d, detail=%s", errObj.Code, errObj.Detail)
-			// 结束下游流
-			endChunk := model.OpenAIResponse{
-				ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   config.MODEL_NAME,
-				Choices: []model.Choice{{Index: 0, Delta: model.Delta{}, FinishReason: "stop"}},
-			}
-			writeSSEChunk(w, endChunk)
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			break
+	// thinking按输出方式发送：reasoning 进入 reasoning_content，其余进入 content
+	think := newThinkFilter(opts.thinkFilterMode())
+	sendThinking := func(s string) {
+		switch {
+		case s == "":
+		case opts.thinkMode == "reasoning":
+			sendDelta(model.Delta{ReasoningContent: s})
+		default:
+			sendDelta(model.Delta{Content: s})
+		}
+	}
+
+	// answer始终进入content：先按 stop 截断，再按 max_tokens 截断，最后解析工具调用
+	stop := newStopFilter(opts.stops)
+	limit := newLengthLimit(opts.maxTokens)
+	sendAnswer := func(s string) {
+		out := limit.Feed(s)
+		var calls []model.ToolCall
+		if opts.tools {
+			out, calls = parser.Feed(out)
 		}
+		if out != "" {
+			logging.Content(ctx, "发送内容", "content", out, "index", index)
+			sendDelta(model.Delta{Content: out})
+		}
+		sendToolCalls(calls)
+	}
 
-		util.DebugLog("解析成功 - 类型: %s, 阶段: %s, 内容长度: %d, 完成: %v",
-			upstreamData.Type, upstreamData.Data.Phase, len(upstreamData.Data.DeltaContent), upstreamData.Data.Done)
+	var usage usageTracker
+	err := h.readUpstream(cc, resp.Body, chatID, func(upstreamData *model.UpstreamData) {
+		usage.observe(upstreamData)
 
-		// 策略2：总是展示thinking + answer
-		if upstreamData.Data.DeltaContent != "" {
-			var out = upstreamData.Data.DeltaContent
-			if upstreamData.Data.Phase == "thinking" {
-				out = transformThinking(out)
-			}
-			if out != "" {
-				util.DebugLog("发送内容(%s): %s", upstreamData.Data.Phase, out)
-				chunk := model.OpenAIResponse{
-					ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   config.MODEL_NAME,
-					Choices: []model.Choice{
-						{
-							Index: 0,
-							Delta: model.Delta{Content: out},
-						},
-					},
-				}
-				writeSSEChunk(w, chunk)
-				flusher.Flush()
+		if upstreamData.Data.DeltaContent == "" {
+			return
+		}
+		if upstreamData.Data.Phase == "thinking" {
+			if opts.thinkMode != "drop" {
+				sendThinking(think.Feed(upstreamData.Data.DeltaContent))
 			}
+			return
+		}
+		sendThinking(think.Flush())
+		sendAnswer(stop.Feed(upstreamData.Data.DeltaContent))
+		if stop.Stopped() || limit.Reached() {
+			cc.finish()
 		}
+	})
+	if clientGone(ctx) {
+		return nil, nil
+	}
+	if cc.finished() {
+		err = nil
+	}
 
-		// 检查是否结束
-		if upstreamData.Data.Done || upstreamData.Data.Phase == "done" {
-			util.DebugLog("检测到流结束信号")
-			// 发送结束chunk
-			endChunk := model.OpenAIResponse{
-				ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   config.MODEL_NAME,
-				Choices: []model.Choice{
-					{
-						Index:        0,
-						Delta:        model.Delta{},
-						FinishReason: "stop",
-					},
-				},
-			}
-			writeSSEChunk(w, endChunk)
-			flusher.Flush()
-
-			// 发送[DONE]
-			fmt.Fprintf(w, "data: [DONE]\n\n")
-			flusher.Flush()
-			util.DebugLog("流式响应完成，共处理%d行", lineCount)
-			break
+	sendThinking(think.Flush())
+	sendAnswer(stop.Flush())
+	finishReason := "stop"
+	if limit.Reached() {
+		finishReason = "length"
+	}
+	// 已完整解析出工具调用时 finish_reason 为 tool_calls，被截断的残缺调用丢弃
+	if opts.tools {
+		var rest string
+		var calls []model.ToolCall
+		if stop.Stopped() || limit.Reached() {
+			calls = parser.Truncate()
+		} else {
+			rest, calls = parser.Flush()
+		}
+		if rest != "" {
+			sendDelta(model.Delta{Content: rest})
+		}
+		sendToolCalls(calls)
+		if parser.Called() {
+			finishReason = "tool_calls"
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		util.DebugLog("扫描器错误: %v", err)
+	// 发送结束chunk。上游中途出错时 finish_reason 为 error，
+	// 多个choice时错误详情放在该choice中，否则由调用方随后发送错误事件
+	end := model.Choice{Index: index, FinishReason: finishReason}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		end.FinishReason = "error"
+		if opts.n > 1 {
+			end.Error = choiceError(apiErr)
+		}
 	}
+	send([]model.Choice{end}, nil)
+	slog.DebugContext(ctx, "choice输出完成", "chat_id", chatID, "index", index, "finish_reason", end.FinishReason)
+
+	u := usage.usage()
+	logUsage(ctx, chatID, u)
+	return u, apiErr
 }
 
-func writeSSEChunk(w http.ResponseWriter, chunk model.OpenAIResponse) {
-	data, _ := json.Marshal(chunk)
-	fmt.Fprintf(w, "data: %s\n\n", data)
+// clientGone 下游客户端是否已断开（请求上下文被取消）。服务关闭导致的取消不算在内，
+// 这时连接仍在，需要向客户端输出错误
+func clientGone(ctx context.Context) bool {
+	return ctx.Err() != nil && !shuttingDown(ctx)
 }
 
-func handleNonStreamResponseWithIDs(w http.ResponseWriter, upstreamReq model.UpstreamRequest, chatID string, authToken string) {
-	util.DebugLog("开始处理非流式响应 (chat_id=%s)", chatID)
+// logCanceled 客户端断开与上游错误分开记录
+func logCanceled(ctx context.Context, chatID string, stage string) {
+	slog.InfoContext(ctx, "客户端已断开，停止转发", "chat_id", chatID, "stage", stage)
+}
+
+func (h *Handler) handleNonStreamResponseWithIDs(ctx context.Context, w http.ResponseWriter, upstreamReqs []model.UpstreamRequest, opts chatOptions) {
+	slog.DebugContext(ctx, "开始处理非流式响应", "chat_id", upstreamReqs[0].ChatID, "n", len(upstreamReqs))
 
-	resp, err := upstream.CallUpstreamWithHeaders(upstreamReq, chatID, authToken)
+	ccs := newChoiceContexts(ctx, len(upstreamReqs))
+	defer cancelAll(ccs)
+	resps, errs, err := h.openChoices(ctx, w, ccs, upstreamReqs)
 	if err != nil {
-		util.DebugLog("调用上游失败: %v", err)
-		http.Error(w, "Failed to call upstream", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
+	defer closeAll(resps)
 
-	if resp.StatusCode != http.StatusOK {
-		util.DebugLog("上游返回错误状态: %d", resp.StatusCode)
-		// 读取错误响应体
-		if config.DEBUG_MODE {
-			body, _ := io.ReadAll(resp.Body)
-			util.DebugLog("上游错误响应: %s", string(body))
+	choices := make([]model.Choice, len(resps))
+	usages := make([]*model.Usage, len(resps))
+	var wg sync.WaitGroup
+	for i, resp := range resps {
+		if resp == nil {
+			continue
 		}
-		http.Error(w, "Upstream error", http.StatusBadGateway)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			choices[i], usages[i], errs[i] = h.collectChoice(ctx, ccs[i], resp, upstreamReqs[i].ChatID, i, opts)
+		}()
+	}
+	wg.Wait()
+
+	if clientGone(ctx) {
+		logCanceled(ctx, upstreamReqs[0].ChatID, "非流式收集中")
+		return
+	}
+	// 所有choice都失败时返回HTTP错误，部分失败时错误放在对应choice中
+	if apiErr := firstError(errs); apiErr != nil {
+		writeAPIError(w, apiErr)
 		return
 	}
+	for i, e := range errs {
+		if e != nil {
+			choices[i].Index = i
+			choices[i].Message.Role = "assistant"
+			choices[i].FinishReason = "error"
+			choices[i].Error = choiceError(e)
+		}
+	}
 
-	// 收集完整响应（策略2：thinking与answer都纳入，thinking转换）
-	var fullContent strings.Builder
-	scanner := bufio.NewScanner(resp.Body)
-	util.DebugLog("开始收集完整响应内容")
+	// 构造完整响应
+	response := model.OpenAIResponse{
+		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   opts.model,
+		Choices: choices,
+		Usage:   mergeUsage(usages),
+	}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+	slog.DebugContext(ctx, "非流式响应发送完成")
+}
 
-		dataStr := strings.TrimPrefix(line, "data: ")
-		if dataStr == "" {
-			continue
+// collectChoice 收集一个choice的完整响应，回答提前结束时与 streamChoice 一样取消上游请求。
+// 上游中途出错时返回错误，choice中保留已收到的内容
+func (h *Handler) collectChoice(ctx context.Context, cc choiceContext, resp *http.Response, chatID string, index int, opts chatOptions) (model.Choice, *model.Usage, *apiError) {
+	// 收集完整响应（thinking按输出方式归入reasoning_content或content）
+	var fullContent, reasoning strings.Builder
+	var toolCalls []model.ToolCall
+	var usage usageTracker
+	parser := tools.NewParser()
+	think := newThinkFilter(opts.thinkFilterMode())
+	thinkingOut := &fullContent
+	if opts.thinkMode == "reasoning" {
+		thinkingOut = &reasoning
+	}
+	slog.DebugContext(ctx, "开始收集完整响应内容", "chat_id", chatID, "index", index)
+
+	stop := newStopFilter(opts.stops)
+	limit := newLengthLimit(opts.maxTokens)
+	addAnswer := func(s string) {
+		out := limit.Feed(s)
+		if opts.tools {
+			var calls []model.ToolCall
+			out, calls = parser.Feed(out)
+			toolCalls = append(toolCalls, calls...)
 		}
+		fullContent.WriteString(out)
+	}
 
-		var upstreamData model.UpstreamData
-		if err := json.Unmarshal([]byte(dataStr), &upstreamData); err != nil {
-			continue
-		}
+	err := h.readUpstream(cc, resp.Body, chatID, func(upstreamData *model.UpstreamData) {
+		usage.observe(upstreamData)
 
-		if upstreamData.Data.DeltaContent != "" {
-			out := upstreamData.Data.DeltaContent
-			if upstreamData.Data.Phase == "thinking" {
-				out = func(s string) string {
-					// 同步一份转换逻辑（与流式一致）
-					s = regexp.MustCompile(`(?s)<summary>.*?</summary>`).ReplaceAllString(s, "")
-					s = strings.ReplaceAll(s, "</thinking>", "")
-					s = strings.ReplaceAll(s, "<Full>", "")
-					s = strings.ReplaceAll(s, "</Full>", "")
-					s = strings.TrimSpace(s)
-					switch config.THINK_TAGS_MODE {
-					case "think":
-						s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "<think>")
-						s = strings.ReplaceAll(s, "</details>", "</think>")
-					case "strip":
-						s = regexp.MustCompile(`<details[^>]*>`).ReplaceAllString(s, "")
-						s = strings.ReplaceAll(s, "</details>", "")
-					}
-					s = strings.TrimPrefix(s, "> ")
-					s = strings.ReplaceAll(s, "\n> ", "\n")
-					return strings.TrimSpace(s)
-				}(out)
-			}
-			if out != "" {
-				fullContent.WriteString(out)
+		if upstreamData.Data.DeltaContent == "" {
+			return
+		}
+		if upstreamData.Data.Phase == "thinking" {
+			if opts.thinkMode != "drop" {
+				thinkingOut.WriteString(think.Feed(upstreamData.Data.DeltaContent))
 			}
+			return
 		}
-
-		if upstreamData.Data.Done || upstreamData.Data.Phase == "done" {
-			util.DebugLog("检测到完成信号，停止收集")
-			break
+		thinkingOut.WriteString(think.Flush())
+		addAnswer(stop.Feed(upstreamData.Data.DeltaContent))
+		if stop.Stopped() || limit.Reached() {
+			cc.finish()
 		}
+	})
+	if cc.finished() {
+		err = nil
 	}
 
-	finalContent := fullContent.String()
-	util.DebugLog("内容收集完成，最终长度: %d", len(finalContent))
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return model.Choice{Message: model.Message{Content: model.TextContent(fullContent.String())}}, nil, apiErr
+	}
+	thinkingOut.WriteString(think.Flush())
+	addAnswer(stop.Flush())
 
-	// 构造完整响应
-	response := model.OpenAIResponse{
-		ID:      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
-		Model:   config.MODEL_NAME,
-		Choices: []model.Choice{
-			{
-				Index: 0,
-				Message: model.Message{
-					Role:    "assistant",
-					Content: finalContent,
-				},
-				FinishReason: "stop",
-			},
-		},
-		Usage: model.Usage{
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		},
+	finishReason := "stop"
+	if limit.Reached() {
+		finishReason = "length"
+	}
+	if opts.tools {
+		if stop.Stopped() || limit.Reached() {
+			toolCalls = append(toolCalls, parser.Truncate()...)
+		} else {
+			rest, calls := parser.Flush()
+			fullContent.WriteString(rest)
+			toolCalls = append(toolCalls, calls...)
+		}
+		if len(toolCalls) > 0 {
+			finishReason = "tool_calls"
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	util.DebugLog("非流式响应发送完成")
+	u := usage.usage()
+	logUsage(ctx, chatID, u)
+
+	finalContent := fullContent.String()
+	slog.DebugContext(ctx, "内容收集完成", "index", index, "length", len(finalContent), "tool_calls", len(toolCalls))
+
+	return model.Choice{
+		Index: index,
+		Message: model.Message{
+			Role:             "assistant",
+			Content:          model.TextContent(finalContent),
+			ReasoningContent: reasoning.String(),
+			ToolCalls:        toolCalls,
+		},
+		FinishReason: finishReason,
+	}, u, nil
 }
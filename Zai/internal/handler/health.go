@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"Zai/internal/model"
+)
+
+// 单次上游探测的超时
+const probeTimeout = 10 * time.Second
+
+// upstreamProbe 缓存最近一次上游探测结果，并发的检查请求共用同一次探测
+type upstreamProbe struct {
+	mu     sync.Mutex
+	result model.HealthCheck
+	at     time.Time
+}
+
+// HandleHealthz 存活检查：进程能处理请求即返回200，不校验key
+func (h *Handler) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, model.HealthResponse{Status: "ok", UptimeSeconds: h.uptime()})
+}
+
+// HandleReadyz 就绪检查：返回启动时的配置校验结果，开启 health.upstream_probe 时再探测上游。不校验key
+func (h *Handler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]model.HealthCheck{}
+	if err := h.configErr; err != nil {
+		checks["config"] = model.HealthCheck{Status: "error", Error: err.Error()}
+	} else {
+		checks["config"] = model.HealthCheck{Status: "ok"}
+	}
+	if h.cfg.Health.UpstreamProbe {
+		checks["upstream"] = h.probeUpstream(r.Context())
+	} else {
+		checks["upstream"] = model.HealthCheck{Status: "skipped"}
+	}
+
+	resp := model.HealthResponse{Status: "ready", UptimeSeconds: h.uptime(), Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.Status == "error" {
+			resp.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, status, resp)
+}
+
+// probeUpstream 返回缓存的探测结果，过期后重新探测。
+// 开启匿名token时获取一次token，否则只检查上游能否连通
+func (h *Handler) probeUpstream(ctx context.Context) model.HealthCheck {
+	p := &h.probe
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.at.IsZero() && time.Since(p.at) < h.cfg.Health.ProbeTTL.Std() {
+		return p.result
+	}
+
+	// 探测不跟随检查请求取消，结果会被后续请求复用
+	probeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), probeTimeout)
+	defer cancel()
+	start := time.Now()
+	result := model.HealthCheck{Status: "ok", Method: "connect"}
+	var err error
+	if h.cfg.AnonTokenEnabled {
+		result.Method = "anon_token"
+		_, err = h.upstream.GetAnonymousToken(probeCtx)
+	} else {
+		err = h.upstream.Probe(probeCtx)
+	}
+	if err != nil {
+		result.Status = "error"
+		result.Error = err.Error()
+		slog.WarnContext(ctx, "上游探测失败", "method", result.Method, "error", err)
+	}
+	result.LatencyMS = time.Since(start).Milliseconds()
+	result.CheckedAt = start.Unix()
+
+	p.result, p.at = result, time.Now()
+	return result
+}
+
+func (h *Handler) uptime() int64 {
+	return int64(time.Since(h.started).Seconds())
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp model.HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// lengthLimit 在估算的token数达到 max_tokens 时截断回答，用于上游不遵守 max_tokens 的情况。
+// 上游不返回分词结果，按字符类别估算：中日韩字符每个约1个token，其他字符约4个一个token
+type lengthLimit struct {
+	max     int // 0 表示不限制
+	used    float64
+	reached bool
+}
+
+func newLengthLimit(max int) *lengthLimit {
+	return &lengthLimit{max: max}
+}
+
+// Feed 返回不超出限制的部分。达到限制后之后的输入全部丢弃
+func (l *lengthLimit) Feed(s string) string {
+	if l.max <= 0 {
+		return s
+	}
+	if l.reached {
+		return ""
+	}
+	for i, r := range s {
+		cost := tokenCost(r)
+		if l.used+cost > float64(l.max) {
+			l.reached = true
+			return s[:i]
+		}
+		l.used += cost
+	}
+	return s
+}
+
+// Reached 是否因达到限制截断过输出
+func (l *lengthLimit) Reached() bool {
+	return l.reached
+}
+
+// tokenCost 单个字符大约占用的token数
+func tokenCost(r rune) float64 {
+	switch {
+	case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+		return 1
+	case r < utf8.RuneSelf:
+		return 0.25
+	default:
+		return 0.5
+	}
+}
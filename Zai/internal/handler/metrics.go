@@ -0,0 +1,22 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"Zai/internal/metrics"
+)
+
+var metricsHandler = metrics.Handler()
+
+// HandleMetrics Prometheus 抓取接口。配置了 metrics.token 时需携带对应的 Bearer token
+func (h *Handler) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if token := h.cfg.Metrics.Token; token != "" {
+		got := apiKeyFromRequest(r)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errTypeAuthentication, "invalid_api_key", "", "Invalid metrics token")
+			return
+		}
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
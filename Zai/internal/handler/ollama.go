@@ -0,0 +1,411 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"Zai/internal/auth"
+	"Zai/internal/config"
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+	"Zai/internal/util"
+)
+
+// ollamaVersion /api/version 返回的版本号，部分客户端据此判断接口能力
+const ollamaVersion = "0.9.0"
+
+// ollamaAnonymousKey 开启 ollama.no_auth 时未带key的请求使用的身份
+var ollamaAnonymousKey = &auth.Key{Name: "ollama-anonymous", Enabled: true}
+
+// authenticateOllama 带了key时按正常流程校验；未带key且允许匿名时使用匿名身份
+func (h *Handler) authenticateOllama(w http.ResponseWriter, r *http.Request) (*auth.Key, bool) {
+	if h.cfg.Ollama.NoAuth && apiKeyFromRequest(r) == "" {
+		return ollamaAnonymousKey, true
+	}
+	key, apiErr := h.checkKey(r)
+	if apiErr != nil {
+		writeOllamaError(w, apiErr.Status, apiErr.Message)
+		return nil, false
+	}
+	return key, true
+}
+
+// ollamaModelName 去掉 Ollama 客户端常带的 :latest 标签
+func (h *Handler) ollamaModelName(name string) string {
+	name = strings.TrimSuffix(name, ":latest")
+	if name == "" {
+		return h.cfg.ModelName
+	}
+	return name
+}
+
+func (h *Handler) ollamaModel(m *config.ModelConfig) model.OllamaModel {
+	sum := sha256.Sum256([]byte(m.ID))
+	return model.OllamaModel{
+		Name:       m.ID,
+		Model:      m.ID,
+		ModifiedAt: h.started.UTC().Format(time.RFC3339),
+		Digest:     hex.EncodeToString(sum[:]),
+		Details:    ollamaDetails(),
+	}
+}
+
+func ollamaDetails() model.OllamaModelDetails {
+	return model.OllamaModelDetails{Format: "api", Family: "glm", Families: []string{"glm"}}
+}
+
+// HandleOllamaVersion GET /api/version
+func (h *Handler) HandleOllamaVersion(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"version": ollamaVersion})
+}
+
+// HandleOllamaTags GET /api/tags
+func (h *Handler) HandleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if _, ok := h.authenticateOllama(w, r); !ok {
+		return
+	}
+	models := make([]model.OllamaModel, 0, len(h.cfg.Models))
+	for i := range h.cfg.Models {
+		models = append(models, h.ollamaModel(&h.cfg.Models[i]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.OllamaTagsResponse{Models: models})
+}
+
+// HandleOllamaShow POST /api/show
+func (h *Handler) HandleOllamaShow(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if _, ok := h.authenticateOllama(w, r); !ok {
+		return
+	}
+	var req model.OllamaShowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Model == "" {
+		req.Model = req.Name
+	}
+	m, ok := h.cfg.Models.Find(h.ollamaModelName(req.Model))
+	if !ok {
+		writeOllamaError(w, http.StatusNotFound, fmt.Sprintf("model '%s' not found", req.Model))
+		return
+	}
+	capabilities := []string{"completion"}
+	if m.Thinking() {
+		capabilities = append(capabilities, "thinking")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.OllamaShowResponse{
+		Details:      ollamaDetails(),
+		ModelInfo:    map[string]interface{}{"general.architecture": "glm"},
+		Capabilities: capabilities,
+		ModifiedAt:   h.started.UTC().Format(time.RFC3339),
+	})
+}
+
+// HandleOllamaChat POST /api/chat
+func (h *Handler) HandleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	key, ok := h.authenticateOllama(w, r)
+	if !ok {
+		return
+	}
+	ctx := auth.WithKey(r.Context(), key)
+
+	var req model.OllamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	req.Model = h.ollamaModelName(req.Model)
+	modelCfg, apiErr := h.checkModel(ctx, key, req.Model)
+	if apiErr != nil {
+		writeOllamaError(w, apiErr.Status, apiErr.Message)
+		return
+	}
+	if len(req.Tools) > 0 && string(req.Tools) != "null" && string(req.Tools) != "[]" {
+		writeOllamaError(w, http.StatusBadRequest, "tools are not supported on /api/chat, use /v1/chat/completions instead")
+		return
+	}
+	messages := make([]model.UpstreamMessage, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		if len(m.Images) > 0 {
+			writeOllamaError(w, http.StatusBadRequest, errImageUnsupported.Message)
+			return
+		}
+		messages = append(messages, model.UpstreamMessage{Role: m.Role, Content: m.Content})
+	}
+	if len(messages) == 0 {
+		writeOllamaError(w, http.StatusBadRequest, "messages is required")
+		return
+	}
+
+	call := ollamaCall{
+		model:    req.Model,
+		modelCfg: modelCfg,
+		messages: messages,
+		options:  req.Options,
+		stream:   req.Stream == nil || *req.Stream,
+		think:    req.Think.Enabled(),
+	}
+	h.runOllama(ctx, w, "chat", call, func(thinking, content, doneReason string, final *model.OllamaStats) interface{} {
+		resp := &model.OllamaChatResponse{
+			Model:     req.Model,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+			Message:   model.OllamaMessage{Role: "assistant", Content: content, Thinking: thinking},
+		}
+		if final != nil {
+			resp.Done, resp.DoneReason, resp.OllamaStats = true, doneReason, *final
+		}
+		return resp
+	})
+}
+
+// HandleOllamaGenerate POST /api/generate
+func (h *Handler) HandleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	key, ok := h.authenticateOllama(w, r)
+	if !ok {
+		return
+	}
+	ctx := auth.WithKey(r.Context(), key)
+
+	var req model.OllamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeOllamaError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	req.Model = h.ollamaModelName(req.Model)
+	modelCfg, apiErr := h.checkModel(ctx, key, req.Model)
+	if apiErr != nil {
+		writeOllamaError(w, apiErr.Status, apiErr.Message)
+		return
+	}
+	if len(req.Images) > 0 {
+		writeOllamaError(w, http.StatusBadRequest, errImageUnsupported.Message)
+		return
+	}
+	// 空prompt在 Ollama 中表示预加载模型，直接返回完成
+	if req.Prompt == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(model.OllamaGenerateResponse{
+			Model:      req.Model,
+			CreatedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	var messages []model.UpstreamMessage
+	if req.System != "" {
+		messages = append(messages, model.UpstreamMessage{Role: "system", Content: req.System})
+	}
+	if req.Suffix != "" {
+		messages = append(messages, model.UpstreamMessage{Role: "system", Content: suffixInstruction + req.Suffix})
+	}
+	messages = append(messages, model.UpstreamMessage{Role: "user", Content: req.Prompt})
+
+	call := ollamaCall{
+		model:    req.Model,
+		modelCfg: modelCfg,
+		messages: messages,
+		options:  req.Options,
+		stream:   req.Stream == nil || *req.Stream,
+		think:    req.Think.Enabled(),
+	}
+	h.runOllama(ctx, w, "generate", call, func(thinking, content, doneReason string, final *model.OllamaStats) interface{} {
+		resp := &model.OllamaGenerateResponse{
+			Model:     req.Model,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+			Response:  content,
+			Thinking:  thinking,
+		}
+		if final != nil {
+			resp.Done, resp.DoneReason, resp.OllamaStats = true, doneReason, *final
+		}
+		return resp
+	})
+}
+
+// ollamaCall chat 与 generate 转换后的公共参数
+type ollamaCall struct {
+	model    string
+	modelCfg *config.ModelConfig
+	messages []model.UpstreamMessage
+	options  model.OllamaOptions
+	stream   bool
+	think    bool
+}
+
+// runOllama 调用上游并按 Ollama 的 NDJSON 格式输出。render 构造单条响应，
+// final 不为空表示最后一条，需要带上 done、done_reason 和耗时统计
+func (h *Handler) runOllama(ctx context.Context, w http.ResponseWriter, endpoint string, call ollamaCall, render func(thinking, content, doneReason string, final *model.OllamaStats) interface{}) {
+	start := time.Now()
+	params := map[string]interface{}{}
+	numPredict := 0 // 与 Ollama 一致，-1 等非正数表示不限制
+	if call.options.NumPredict != nil && *call.options.NumPredict > 0 {
+		numPredict = *call.options.NumPredict
+		params["max_tokens"] = numPredict
+	}
+	if call.options.Temperature != nil {
+		params["temperature"] = *call.options.Temperature
+	}
+	if call.options.TopP != nil {
+		params["top_p"] = *call.options.TopP
+	}
+	if len(call.options.Stop) > 0 {
+		params["stop"] = call.options.Stop
+	}
+
+	upstreamReq := h.newUpstreamRequest(call.modelCfg, call.messages, params)
+	slog.InfoContext(ctx, "ollama", "endpoint", endpoint, "model", call.model, "stream", call.stream, "chat_id", upstreamReq.ChatID)
+
+	// 上游可能忽略 stop 和 num_predict，由代理在回答上再执行一次，截断后立即取消上游请求
+	cc := newChoiceContexts(ctx, 1)[0]
+	defer cc.cancel(nil)
+	resp, err := h.openUpstream(cc, w, upstreamReq)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		writeOllamaError(w, apiErr.Status, apiErr.Message)
+		return
+	} else if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var flusher http.Flusher
+	if call.stream {
+		var ok bool
+		if flusher, ok = w.(http.Flusher); !ok {
+			writeOllamaError(w, http.StatusInternalServerError, "streaming unsupported")
+			return
+		}
+		metrics.MarkStream(ctx)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	writeLine := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		w.Write(append(data, '\n'))
+		flusher.Flush()
+	}
+
+	var firstToken time.Time
+	var thinking, content strings.Builder
+	emit := func(t, c string) {
+		if firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+		if call.stream {
+			writeLine(render(t, c, "", nil))
+			return
+		}
+		thinking.WriteString(t)
+		content.WriteString(c)
+	}
+
+	answer := newAnswerFilter(cc, call.options.Stop, numPredict)
+	think := newThinkFilter("strip")
+	emitThinking := func(t string) {
+		if t != "" {
+			emit(t, "")
+		}
+	}
+	var usage usageTracker
+	err = h.readUpstream(cc, resp.Body, upstreamReq.ChatID, func(data *model.UpstreamData) {
+		usage.observe(data)
+		if data.Data.DeltaContent == "" {
+			return
+		}
+		if data.Data.Phase == "thinking" {
+			if !call.think {
+				return
+			}
+			emitThinking(think.Feed(data.Data.DeltaContent))
+			return
+		}
+		emitThinking(think.Flush())
+		if c := answer.Feed(data.Data.DeltaContent); c != "" {
+			emit("", c)
+		}
+	})
+	err = answer.result(err)
+	if clientGone(ctx) {
+		logCanceled(ctx, upstreamReq.ChatID, "ollama "+endpoint)
+		return
+	}
+	if errors.As(err, &apiErr) {
+		if !call.stream {
+			writeOllamaError(w, apiErr.Status, apiErr.Message)
+			return
+		}
+		// Ollama 流中途出错时以单独的 error 行结束
+		writeLine(model.OllamaErrorResponse{Error: apiErr.Message})
+		return
+	}
+	emitThinking(think.Flush())
+	if c := answer.Flush(); c != "" {
+		emit("", c)
+	}
+
+	u := usage.usage()
+	logUsage(ctx, upstreamReq.ChatID, u)
+
+	end := time.Now()
+	if firstToken.IsZero() {
+		firstToken = end
+	}
+	stats := model.OllamaStats{
+		TotalDuration:      end.Sub(start).Nanoseconds(),
+		PromptEvalCount:    u.PromptTokens,
+		PromptEvalDuration: firstToken.Sub(start).Nanoseconds(),
+		EvalCount:          u.CompletionTokens,
+		EvalDuration:       end.Sub(firstToken).Nanoseconds(),
+	}
+	// 因 num_predict 截断时 done_reason 为 length
+	doneReason := "stop"
+	if answer.Reached() {
+		doneReason = "length"
+	}
+	if call.stream {
+		writeLine(render("", "", doneReason, &stats))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(render(thinking.String(), content.String(), doneReason, &stats))
+}
+
+// writeOllamaError Ollama 的错误格式：{"error":"..."}
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(model.OllamaErrorResponse{Error: message})
+}
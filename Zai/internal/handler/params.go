@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"Zai/internal/model"
+)
+
+// maxStopSequences 与 OpenAI 一致，最多4个stop序列
+const maxStopSequences = 4
+
+// chatParams 校验 chat completions 的采样参数并转换为上游 params，未设置的参数不发送。
+// 返回的 maxTokens 为 max_completion_tokens 或 max_tokens（前者优先），0 表示不限制
+func chatParams(req *model.OpenAIRequest) (params map[string]interface{}, maxTokens int, apiErr *apiError) {
+	invalid := func(param, msg string) (map[string]interface{}, int, *apiError) {
+		return nil, 0, &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Code: "invalid_value", Param: param, Message: msg}
+	}
+
+	params = map[string]interface{}{}
+	for _, p := range []struct {
+		name   string
+		value  *float64
+		lo, hi float64
+	}{
+		{"temperature", req.Temperature, 0, 2},
+		{"top_p", req.TopP, 0, 1},
+		{"presence_penalty", req.PresencePenalty, -2, 2},
+		{"frequency_penalty", req.FrequencyPenalty, -2, 2},
+	} {
+		if p.value == nil {
+			continue
+		}
+		if *p.value < p.lo || *p.value > p.hi {
+			return invalid(p.name, fmt.Sprintf("%s must be between %g and %g", p.name, p.lo, p.hi))
+		}
+		params[p.name] = *p.value
+	}
+
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{
+		{"max_tokens", req.MaxTokens},
+		{"max_completion_tokens", req.MaxCompletionTokens},
+	} {
+		if p.value == nil {
+			continue
+		}
+		if *p.value < 1 {
+			return invalid(p.name, p.name+" must be at least 1")
+		}
+		maxTokens = *p.value
+	}
+	if maxTokens > 0 {
+		params["max_tokens"] = maxTokens
+	}
+
+	if len(req.Stop) > maxStopSequences {
+		return invalid("stop", fmt.Sprintf("stop supports at most %d sequences", maxStopSequences))
+	}
+	if len(req.Stop) > 0 {
+		params["stop"] = []string(req.Stop)
+	}
+	return params, maxTokens, nil
+}
+
+// completionParams 以 chatParams 的规则校验 /v1/completions 的参数，两个接口对同样的输入返回同样的错误
+func completionParams(req *model.CompletionRequest) (map[string]interface{}, int, *apiError) {
+	return chatParams(&model.OpenAIRequest{
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		MaxTokens:   req.MaxTokens,
+		Stop:        req.Stop,
+	})
+}
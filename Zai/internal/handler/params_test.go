@@ -0,0 +1,486 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"Zai/internal/model"
+	"Zai/internal/upstream/upstreamtest"
+)
+
+func TestChatForwardsSamplingParams(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript)
+
+	rec := doChat(t, h, `{"temperature":0.3,"top_p":0.8,"max_tokens":100,"presence_penalty":0.5,"frequency_penalty":-0.5,
+		"stop":"END","messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	want := map[string]interface{}{
+		"temperature":       0.3,
+		"top_p":             0.8,
+		"max_tokens":        float64(100),
+		"presence_penalty":  0.5,
+		"frequency_penalty": -0.5,
+		"stop":              []interface{}{"END"},
+	}
+	if got := up.Requests()[0].Body.Params; !reflect.DeepEqual(got, want) {
+		t.Errorf("params = %v, want %v", got, want)
+	}
+}
+
+func TestChatNullStop(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(basicScript)
+
+	rec := doChat(t, h, `{"stop":null,"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if stop, ok := up.Requests()[0].Body.Params["stop"]; ok {
+		t.Errorf("stop 为 null 时仍发送了 stop = %v", stop)
+	}
+}
+
+func doCompletion(t *testing.T, h *Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testKey)
+	rec := httptest.NewRecorder()
+	h.HandleCompletions(rec, req)
+	return rec
+}
+
+func TestCompletionsNullPrompt(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	rec := doCompletion(t, h, `{"prompt":null}`)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	assertErrorCode(t, rec, "missing_required_parameter")
+	if n := len(up.Requests()); n != 0 {
+		t.Errorf("上游请求数 = %d, want 0", n)
+	}
+}
+
+func TestResponsesNullInput(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(`{"input":null}`))
+	req.Header.Set("Authorization", "Bearer "+testKey)
+	rec := httptest.NewRecorder()
+	h.HandleResponses(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	assertErrorCode(t, rec, "missing_required_parameter")
+	if n := len(up.Requests()); n != 0 {
+		t.Errorf("上游请求数 = %d, want 0", n)
+	}
+}
+
+// /v1/chat/completions 与 /v1/completions 对同样的非法参数返回同样的400
+func TestInvalidSamplingParams(t *testing.T) {
+	tests := []struct {
+		field string
+		param string
+	}{
+		{`"temperature":3`, "temperature"},
+		{`"top_p":-0.1`, "top_p"},
+		{`"max_tokens":0`, "max_tokens"},
+		{`"max_tokens":-5`, "max_tokens"},
+		{`"stop":["a","b","c","d","e"]`, "stop"},
+	}
+	endpoints := []struct {
+		name string
+		do   func(t *testing.T, h *Handler, field string) *httptest.ResponseRecorder
+	}{
+		{"chat", func(t *testing.T, h *Handler, field string) *httptest.ResponseRecorder {
+			return doChat(t, h, `{`+field+`,"messages":[]}`)
+		}},
+		{"completions", func(t *testing.T, h *Handler, field string) *httptest.ResponseRecorder {
+			return doCompletion(t, h, `{`+field+`,"prompt":"hi"}`)
+		}},
+	}
+	for _, ep := range endpoints {
+		for _, tt := range tests {
+			t.Run(ep.name+"/"+tt.field, func(t *testing.T) {
+				h, up := newTestHandler(t, nil)
+				rec := ep.do(t, h, tt.field)
+				if rec.Code != http.StatusBadRequest {
+					t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+				}
+				assertErrorCode(t, rec, "invalid_value")
+				var resp struct {
+					Error struct{ Param string } `json:"error"`
+				}
+				decodeJSON(t, rec.Body.Bytes(), &resp)
+				if resp.Error.Param != tt.param {
+					t.Errorf("param = %q, want %q", resp.Error.Param, tt.param)
+				}
+				if n := len(up.Requests()); n != 0 {
+					t.Errorf("上游请求数 = %d, want 0", n)
+				}
+			})
+		}
+	}
+}
+
+// stop 序列被拆在两个事件里也要截断，之后的内容不再输出
+func TestChatStreamEnforcesStop(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer("第一段EN"),
+		upstreamtest.Answer("D第二段"),
+		upstreamtest.Answer("第三段"),
+		upstreamtest.Done(nil),
+	}})
+
+	rec := doChat(t, h, `{"stream":true,"stop":["END"],"messages":[{"role":"user","content":"hi"}]}`)
+	assertEvents(t, rec.Body.String(),
+		chunk(`{"role":"assistant"}`, ""),
+		chunk(`{"content":"第一段"}`, ""),
+		chunk(`{}`, "stop"),
+		"[DONE]",
+	)
+}
+
+func TestChatStreamEnforcesMaxTokens(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Lines: []string{
+		upstreamtest.Thinking("思考不计入限制"),
+		upstreamtest.Answer("一二"),
+		upstreamtest.Answer("三四五"),
+		upstreamtest.Answer("六"),
+		upstreamtest.Done(nil),
+	}})
+
+	rec := doChat(t, h, `{"stream":true,"max_tokens":4,"messages":[{"role":"user","content":"hi"}]}`)
+	assertEvents(t, rec.Body.String(),
+		chunk(`{"role":"assistant"}`, ""),
+		chunk(`{"reasoning_content":"思考不计入限制"}`, ""),
+		chunk(`{"content":"一二"}`, ""),
+		chunk(`{"content":"三四"}`, ""),
+		chunk(`{}`, "length"),
+		"[DONE]",
+	)
+}
+
+func TestChatNonStreamEnforcesStopAndMaxTokens(t *testing.T) {
+	script := upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer("hello wor"),
+		upstreamtest.Answer("ld, how are you"),
+		upstreamtest.Done(nil),
+	}}
+	tests := []struct {
+		name   string
+		body   string
+		text   string
+		finish string
+	}{
+		{"stop", `{"stop":[", "],"messages":[]}`, "hello world", "stop"},
+		{"max_completion_tokens", `{"max_completion_tokens":2,"max_tokens":100,"messages":[]}`, "hello wo", "length"},
+		{"no limit", `{"messages":[]}`, "hello world, how are you", "stop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, up := newTestHandler(t, nil)
+			up.Enqueue(script)
+			rec := doChat(t, h, tt.body)
+			var resp model.OpenAIResponse
+			decodeJSON(t, rec.Body.Bytes(), &resp)
+			if got := resp.Choices[0].Message.Content.Text(); got != tt.text {
+				t.Errorf("content = %q, want %q", got, tt.text)
+			}
+			if got := resp.Choices[0].FinishReason; got != tt.finish {
+				t.Errorf("finish_reason = %q, want %q", got, tt.finish)
+			}
+		})
+	}
+}
+
+// 命中 stop 或达到 max_tokens 后立即结束并取消上游请求，不等上游把剩余内容生成完
+func TestChatStopsReadingAfterCut(t *testing.T) {
+	slow := upstreamtest.Script{Delay: 2 * time.Second, Lines: []string{
+		upstreamtest.Answer("一二三END四五"),
+		upstreamtest.Answer("六七八"),
+		upstreamtest.Done(nil),
+	}}
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"stop stream", `{"stream":true,"stop":"END","messages":[]}`, []string{
+			chunk(`{"role":"assistant"}`, ""),
+			chunk(`{"content":"一二三"}`, ""),
+			chunk(`{}`, "stop"),
+			"[DONE]",
+		}},
+		{"max_tokens stream", `{"stream":true,"max_tokens":2,"messages":[]}`, []string{
+			chunk(`{"role":"assistant"}`, ""),
+			chunk(`{"content":"一二"}`, ""),
+			chunk(`{}`, "length"),
+			"[DONE]",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, up := newTestHandler(t, nil)
+			up.Enqueue(slow)
+			start := time.Now()
+			rec := doChat(t, h, tt.body)
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("耗时 %s，仍在等待上游", d)
+			}
+			assertEvents(t, rec.Body.String(), tt.want...)
+		})
+	}
+
+	t.Run("non-stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(slow)
+		start := time.Now()
+		rec := doChat(t, h, `{"stop":"END","messages":[]}`)
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("耗时 %s，仍在等待上游", d)
+		}
+		var resp model.OpenAIResponse
+		decodeJSON(t, rec.Body.Bytes(), &resp)
+		if c := resp.Choices[0]; c.Message.Content.Text() != "一二三" || c.FinishReason != "stop" {
+			t.Errorf("content = %q, finish_reason = %q", c.Message.Content.Text(), c.FinishReason)
+		}
+	})
+}
+
+// max_tokens 截断在工具调用中间时，残缺的调用不作为 content 输出；只缺结束标签的调用照常返回
+func TestChatMaxTokensInsideToolCall(t *testing.T) {
+	script := upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer(`ok <tool_call>{"name":"get_weather","arguments":{"city":"Paris"}}</tool_call>`),
+		upstreamtest.Done(nil),
+	}}
+	const tools = `"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}]`
+	tests := []struct {
+		name      string
+		maxTokens string
+		calls     int
+		finish    string
+	}{
+		// 20个ASCII字符，截断在参数中间
+		{"参数未完整", "5", 0, "length"},
+		// 68个ASCII字符，只截掉结束标签
+		{"缺结束标签", "17", 1, "tool_calls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, up := newTestHandler(t, nil)
+			up.Enqueue(script)
+			rec := doChat(t, h, `{"max_tokens":`+tt.maxTokens+`,`+tools+`,"messages":[{"role":"user","content":"hi"}]}`)
+			var resp model.OpenAIResponse
+			decodeJSON(t, rec.Body.Bytes(), &resp)
+			c := resp.Choices[0]
+			if got := c.Message.Content.Text(); got != "ok " {
+				t.Errorf("content = %q, want %q", got, "ok ")
+			}
+			if len(c.Message.ToolCalls) != tt.calls || c.FinishReason != tt.finish {
+				t.Errorf("tool_calls = %d, finish_reason = %q, want %d, %q", len(c.Message.ToolCalls), c.FinishReason, tt.calls, tt.finish)
+			}
+		})
+	}
+}
+
+// 指定的函数不在 tools 中时与 OpenAI 一致返回400，存在时正常调用上游
+func TestChatToolChoiceFunction(t *testing.T) {
+	const tools = `"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object"}}}]`
+	choice := func(name string) string {
+		return `"tool_choice":{"type":"function","function":{"name":"` + name + `"}}`
+	}
+
+	h, up := newTestHandler(t, nil)
+	rec := doChat(t, h, `{`+tools+`,`+choice("get_time")+`,"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	assertErrorCode(t, rec, "invalid_value")
+	if n := len(up.Requests()); n != 0 {
+		t.Errorf("上游请求数 = %d, want 0", n)
+	}
+
+	up.Enqueue(basicScript)
+	rec = doChat(t, h, `{`+tools+`,`+choice("get_weather")+`,"messages":[{"role":"user","content":"hi"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCompletionsEnforcesMaxTokens(t *testing.T) {
+	h, up := newTestHandler(t, nil)
+	up.Enqueue(upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer("一二三"),
+		upstreamtest.Answer("四五"),
+		upstreamtest.Done(nil),
+	}})
+
+	rec := doCompletion(t, h, `{"prompt":"数数","max_tokens":2}`)
+	var resp model.CompletionResponse
+	decodeJSON(t, rec.Body.Bytes(), &resp)
+	if c := resp.Choices[0]; c.Text != "一二" || c.FinishReason == nil || *c.FinishReason != "length" {
+		t.Errorf("choice = %+v", c)
+	}
+}
+
+func doAnthropic(t *testing.T, h *Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	req.Header.Set("x-api-key", testKey)
+	rec := httptest.NewRecorder()
+	h.HandleAnthropicMessages(rec, req)
+	return rec
+}
+
+func TestAnthropicEnforcesStopSequencesAndMaxTokens(t *testing.T) {
+	script := upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer("一二三###"),
+		upstreamtest.Answer("四五"),
+		upstreamtest.Done(nil),
+	}}
+
+	t.Run("stop_sequence stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doAnthropic(t, h, `{"max_tokens":100,"stream":true,"stop_sequences":["##"],"messages":[{"role":"user","content":"hi"}]}`)
+		body := rec.Body.String()
+		if !strings.Contains(body, `"text":"一二三"`) || strings.Contains(body, "四五") {
+			t.Errorf("回答未按 stop_sequences 截断:\n%s", body)
+		}
+		if !strings.Contains(body, `"stop_reason":"stop_sequence","stop_sequence":"##"`) {
+			t.Errorf("message_delta 缺少 stop_sequence:\n%s", body)
+		}
+	})
+	t.Run("max_tokens", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doAnthropic(t, h, `{"max_tokens":2,"messages":[{"role":"user","content":"hi"}]}`)
+		var resp model.AnthropicResponse
+		decodeJSON(t, rec.Body.Bytes(), &resp)
+		if got := resp.Content[len(resp.Content)-1].Text; got != "一二" {
+			t.Errorf("text = %q, want 一二", got)
+		}
+		if resp.StopReason == nil || *resp.StopReason != "max_tokens" || resp.StopSequence != nil {
+			t.Errorf("stop_reason = %v, stop_sequence = %v", resp.StopReason, resp.StopSequence)
+		}
+	})
+}
+
+func doGemini(t *testing.T, h *Handler, method, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/GLM-4.5:"+method, strings.NewReader(body))
+	req.Header.Set("x-goog-api-key", testKey)
+	rec := httptest.NewRecorder()
+	h.HandleGemini(rec, req)
+	return rec
+}
+
+func TestGeminiEnforcesStopSequencesAndMaxOutputTokens(t *testing.T) {
+	script := upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer("一二三###"),
+		upstreamtest.Answer("四五"),
+		upstreamtest.Done(nil),
+	}}
+	const contents = `"contents":[{"role":"user","parts":[{"text":"hi"}]}]`
+
+	t.Run("stopSequences stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doGemini(t, h, "streamGenerateContent?alt=sse", `{"generationConfig":{"stopSequences":["##"]},`+contents+`}`)
+		body := rec.Body.String()
+		if !strings.Contains(body, `"text":"一二三"`) || strings.Contains(body, "四五") {
+			t.Errorf("回答未按 stopSequences 截断:\n%s", body)
+		}
+		if !strings.Contains(body, `"finishReason":"STOP"`) {
+			t.Errorf("缺少 finishReason STOP:\n%s", body)
+		}
+	})
+	t.Run("maxOutputTokens", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doGemini(t, h, "generateContent", `{"generationConfig":{"maxOutputTokens":2},`+contents+`}`)
+		var resp model.GeminiResponse
+		decodeJSON(t, rec.Body.Bytes(), &resp)
+		c := resp.Candidates[0]
+		if got := c.Content.Parts[len(c.Content.Parts)-1].Text; got != "一二" {
+			t.Errorf("text = %q, want 一二", got)
+		}
+		if c.FinishReason != "MAX_TOKENS" {
+			t.Errorf("finishReason = %q, want MAX_TOKENS", c.FinishReason)
+		}
+	})
+}
+
+func TestOllamaEnforcesStopAndNumPredict(t *testing.T) {
+	script := upstreamtest.Script{Lines: []string{
+		upstreamtest.Answer("一二三###"),
+		upstreamtest.Answer("四五"),
+		upstreamtest.Done(nil),
+	}}
+	doOllama := func(t *testing.T, h *Handler, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testKey)
+		rec := httptest.NewRecorder()
+		if path == "/api/chat" {
+			h.HandleOllamaChat(rec, req)
+		} else {
+			h.HandleOllamaGenerate(rec, req)
+		}
+		return rec
+	}
+
+	t.Run("stop chat stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doOllama(t, h, "/api/chat", `{"options":{"stop":["##"]},"messages":[{"role":"user","content":"hi"}]}`)
+		body := rec.Body.String()
+		if !strings.Contains(body, `"content":"一二三"`) || strings.Contains(body, "四五") {
+			t.Errorf("回答未按 stop 截断:\n%s", body)
+		}
+		if !strings.Contains(body, `"done":true,"done_reason":"stop"`) {
+			t.Errorf("最后一行 done_reason 不是 stop:\n%s", body)
+		}
+	})
+	t.Run("num_predict generate", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doOllama(t, h, "/api/generate", `{"stream":false,"options":{"num_predict":2},"prompt":"hi"}`)
+		var resp model.OllamaGenerateResponse
+		decodeJSON(t, rec.Body.Bytes(), &resp)
+		if resp.Response != "一二" || resp.DoneReason != "length" {
+			t.Errorf("response = %q, done_reason = %q, want 一二, length", resp.Response, resp.DoneReason)
+		}
+	})
+}
+
+func TestLengthLimit(t *testing.T) {
+	l := newLengthLimit(3)
+	// 中文每字1个token，ASCII 每4个字符1个token
+	if got := l.Feed("ab你cd"); got != "ab你cd" {
+		t.Errorf("第一段 = %q", got)
+	}
+	if got := l.Feed("好吗"); got != "好" || !l.Reached() {
+		t.Errorf("第二段 = %q, reached = %v", got, l.Reached())
+	}
+	if got := l.Feed("x"); got != "" {
+		t.Errorf("达到限制后仍输出 %q", got)
+	}
+
+	unlimited := newLengthLimit(0)
+	if got := unlimited.Feed("任意长度"); got != "任意长度" || unlimited.Reached() {
+		t.Errorf("不限制时 = %q", got)
+	}
+}
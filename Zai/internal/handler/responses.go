@@ -0,0 +1,355 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"Zai/internal/auth"
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+	"Zai/internal/responses"
+	"Zai/internal/util"
+)
+
+const responsesPath = "/v1/responses"
+
+// HandleResponses OpenAI Responses API：POST /v1/responses 与 GET /v1/responses/{id}
+func (h *Handler) HandleResponses(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	key, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	ctx := auth.WithKey(r.Context(), key)
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, responsesPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		h.createResponse(ctx, w, r, key)
+	case id != "" && !strings.Contains(id, "/") && r.Method == http.MethodGet:
+		entry, apiErr := h.storedResponse(key, id, "")
+		if apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry.Response)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errTypeInvalidRequest, "method_not_allowed", "", fmt.Sprintf("Method %s is not allowed on %s", r.Method, r.URL.Path))
+	}
+}
+
+// storedResponse 读取同一key保存的响应，其他key的记录视为不存在
+func (h *Handler) storedResponse(key *auth.Key, id, param string) (*responses.Entry, *apiError) {
+	entry, ok := h.responses.Get(id)
+	if !ok || entry.KeyName != key.Name {
+		return nil, &apiError{Status: http.StatusNotFound, Type: errTypeInvalidRequest, Code: "response_not_found", Param: param,
+			Message: fmt.Sprintf("Response with id '%s' not found.", id)}
+	}
+	return entry, nil
+}
+
+func (h *Handler) createResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, key *auth.Key) {
+	var req model.ResponsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.DebugContext(ctx, "JSON解析失败", "error", err)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "invalid_json", "", "Invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Model == "" {
+		req.Model = h.cfg.ModelName
+	}
+	modelCfg, apiErr := h.checkModel(ctx, key, req.Model)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	// 续接对话时先重放上一轮保存的完整历史，instructions 不继承
+	var history []model.UpstreamMessage
+	if req.PreviousResponseID != "" {
+		prev, apiErr := h.storedResponse(key, req.PreviousResponseID, "previous_response_id")
+		if apiErr != nil {
+			writeAPIError(w, apiErr)
+			return
+		}
+		history = append(history, prev.Messages...)
+	}
+	added := 0
+	for i, item := range req.Input {
+		switch item.Type {
+		case "", "message":
+		case "reasoning":
+			// 客户端回传的思考内容不再发给上游
+			continue
+		default:
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "unsupported_input", fmt.Sprintf("input[%d].type", i),
+				fmt.Sprintf("Input item type %q is not supported", item.Type))
+			return
+		}
+		if item.Content.HasImages() {
+			writeAPIError(w, &apiError{Status: http.StatusBadRequest, Type: errTypeInvalidRequest, Code: "unsupported_content", Param: "input",
+				Message: errImageUnsupported.Message})
+			return
+		}
+		role := item.Role
+		if role == "developer" {
+			role = "system"
+		}
+		history = append(history, model.UpstreamMessage{Role: role, Content: item.Content.Text()})
+		added++
+	}
+	if added == 0 {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "missing_required_parameter", "input", "input is required")
+		return
+	}
+
+	messages := make([]model.UpstreamMessage, 0, len(history)+1)
+	if req.Instructions != "" {
+		messages = append(messages, model.UpstreamMessage{Role: "system", Content: req.Instructions})
+	}
+	messages = append(messages, history...)
+
+	params := map[string]interface{}{}
+	if req.MaxOutputTokens != nil {
+		params["max_tokens"] = *req.MaxOutputTokens
+	}
+	if req.Temperature != nil {
+		params["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		params["top_p"] = *req.TopP
+	}
+
+	store := req.Store == nil || *req.Store
+	obj := &model.ResponseObject{
+		ID:              responses.NewID("resp"),
+		Object:          "response",
+		CreatedAt:       time.Now().Unix(),
+		Status:          "in_progress",
+		Model:           req.Model,
+		Output:          []model.ResponseItem{},
+		Store:           store,
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		MaxOutputTokens: req.MaxOutputTokens,
+		Metadata:        req.Metadata,
+	}
+	if obj.Metadata == nil {
+		obj.Metadata = map[string]string{}
+	}
+	if req.Instructions != "" {
+		obj.Instructions = &req.Instructions
+	}
+	if req.PreviousResponseID != "" {
+		obj.PreviousResponseID = &req.PreviousResponseID
+	}
+
+	upstreamReq := h.newUpstreamRequest(modelCfg, messages, params)
+	slog.InfoContext(ctx, "responses", "model", req.Model, "stream", req.Stream, "id", obj.ID,
+		"previous", req.PreviousResponseID, "chat_id", upstreamReq.ChatID)
+
+	resp, err := h.openUpstream(ctx, w, upstreamReq)
+	if errors.As(err, &apiErr) {
+		writeAPIError(w, apiErr)
+		return
+	} else if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	b := &responseBuilder{obj: obj, emit: func(model.ResponseStreamEvent) {}}
+	if req.Stream {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, errTypeServer, "streaming_unsupported", "", "Streaming unsupported")
+			return
+		}
+		metrics.MarkStream(ctx)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		seq := 0
+		b.emit = func(ev model.ResponseStreamEvent) {
+			ev.SequenceNumber = seq
+			seq++
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+		b.emit(model.ResponseStreamEvent{Type: "response.created", Response: obj})
+		b.emit(model.ResponseStreamEvent{Type: "response.in_progress", Response: obj})
+	}
+
+	think := newThinkFilter("strip")
+	writeReasoning := func(t string) {
+		if t != "" {
+			b.write("reasoning", t)
+		}
+	}
+	var usage usageTracker
+	err = h.readUpstream(ctx, resp.Body, upstreamReq.ChatID, func(data *model.UpstreamData) {
+		usage.observe(data)
+		if data.Data.DeltaContent == "" {
+			return
+		}
+		if data.Data.Phase == "thinking" {
+			writeReasoning(think.Feed(data.Data.DeltaContent))
+			return
+		}
+		writeReasoning(think.Flush())
+		b.write("message", data.Data.DeltaContent)
+	})
+	if clientGone(ctx) {
+		logCanceled(ctx, upstreamReq.ChatID, "responses")
+		return
+	}
+
+	u := usage.usage()
+	logUsage(ctx, upstreamReq.ChatID, u)
+
+	if errors.As(err, &apiErr) {
+		b.failed = true
+		b.closeItem()
+		if !req.Stream {
+			writeAPIError(w, apiErr)
+			return
+		}
+		code := apiErr.Code
+		if code == "" {
+			code = apiErr.Type
+		}
+		obj.Status = "failed"
+		obj.Error = &model.ResponseError{Code: code, Message: apiErr.Message}
+		b.emit(model.ResponseStreamEvent{Type: "response.failed", Response: obj})
+		return
+	}
+
+	writeReasoning(think.Flush())
+	// 没有回答内容时也输出一个空的 message 项
+	if b.answer.Len() == 0 && b.current != "message" {
+		b.open("message")
+	}
+	b.closeItem()
+	obj.Status = "completed"
+	obj.Usage = &model.ResponseUsage{
+		InputTokens:         u.PromptTokens,
+		OutputTokens:        u.CompletionTokens,
+		OutputTokensDetails: model.ResponseOutputTokensDetails{ReasoningTokens: u.CompletionTokensDetails.ReasoningTokens},
+		TotalTokens:         u.TotalTokens,
+	}
+
+	if store {
+		h.responses.Put(obj.ID, &responses.Entry{
+			Response: obj,
+			Messages: append(history, model.UpstreamMessage{Role: "assistant", Content: b.answer.String()}),
+			KeyName:  key.Name,
+		})
+	}
+
+	if req.Stream {
+		b.emit(model.ResponseStreamEvent{Type: "response.completed", Response: obj})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+// responseBuilder 把上游增量组装成输出项，并通过 emit 发出对应的流式事件。
+// 非流式时 emit 为空操作，两种模式共用同一套组装逻辑
+type responseBuilder struct {
+	obj  *model.ResponseObject
+	emit func(model.ResponseStreamEvent)
+
+	current string // 当前打开的输出项类型，空表示没有
+	failed  bool   // 上游中途失败，未完成的 message 标记为 incomplete
+	index   int
+	item    model.ResponseItem
+	text    strings.Builder
+	answer  strings.Builder // 所有回答文本，用于保存对话历史
+}
+
+func (b *responseBuilder) write(itemType, delta string) {
+	b.open(itemType)
+	b.text.WriteString(delta)
+	if itemType == "message" {
+		b.answer.WriteString(delta)
+	}
+	idx, sub := b.index, 0
+	ev := model.ResponseStreamEvent{ItemID: b.item.ID, OutputIndex: &idx, Delta: delta}
+	if itemType == "reasoning" {
+		ev.Type, ev.SummaryIndex = "response.reasoning_summary_text.delta", &sub
+	} else {
+		ev.Type, ev.ContentIndex = "response.output_text.delta", &sub
+	}
+	b.emit(ev)
+}
+
+func (b *responseBuilder) open(itemType string) {
+	if b.current == itemType {
+		return
+	}
+	b.closeItem()
+	b.current = itemType
+	b.index = len(b.obj.Output)
+	b.text.Reset()
+	if itemType == "reasoning" {
+		b.item = model.ResponseItem{Type: "reasoning", ID: responses.NewID("rs")}
+	} else {
+		b.item = model.ResponseItem{Type: "message", ID: responses.NewID("msg"), Status: "in_progress", Role: "assistant"}
+	}
+	b.obj.Output = append(b.obj.Output, b.item)
+
+	idx, sub := b.index, 0
+	item := b.item
+	b.emit(model.ResponseStreamEvent{Type: "response.output_item.added", OutputIndex: &idx, Item: &item})
+	part := b.part("")
+	if itemType == "reasoning" {
+		b.emit(model.ResponseStreamEvent{Type: "response.reasoning_summary_part.added", ItemID: b.item.ID, OutputIndex: &idx, SummaryIndex: &sub, Part: &part})
+	} else {
+		b.emit(model.ResponseStreamEvent{Type: "response.content_part.added", ItemID: b.item.ID, OutputIndex: &idx, ContentIndex: &sub, Part: &part})
+	}
+}
+
+func (b *responseBuilder) closeItem() {
+	if b.current == "" {
+		return
+	}
+	idx, sub := b.index, 0
+	text := b.text.String()
+	part := b.part(text)
+	if b.current == "reasoning" {
+		b.emit(model.ResponseStreamEvent{Type: "response.reasoning_summary_text.done", ItemID: b.item.ID, OutputIndex: &idx, SummaryIndex: &sub, Text: &text})
+		b.emit(model.ResponseStreamEvent{Type: "response.reasoning_summary_part.done", ItemID: b.item.ID, OutputIndex: &idx, SummaryIndex: &sub, Part: &part})
+	} else {
+		b.emit(model.ResponseStreamEvent{Type: "response.output_text.done", ItemID: b.item.ID, OutputIndex: &idx, ContentIndex: &sub, Text: &text})
+		b.emit(model.ResponseStreamEvent{Type: "response.content_part.done", ItemID: b.item.ID, OutputIndex: &idx, ContentIndex: &sub, Part: &part})
+		b.item.Status = "completed"
+		if b.failed {
+			b.item.Status = "incomplete"
+		}
+	}
+	b.item.Content = []model.ResponseContentPart{part}
+	b.obj.Output[b.index] = b.item
+	item := b.item
+	b.emit(model.ResponseStreamEvent{Type: "response.output_item.done", OutputIndex: &idx, Item: &item})
+	b.current = ""
+}
+
+func (b *responseBuilder) part(text string) model.ResponseContentPart {
+	if b.current == "reasoning" {
+		return model.ResponseContentPart{Type: "summary_text", Text: text}
+	}
+	return model.ResponseContentPart{Type: "output_text", Text: text}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"slices"
+	"time"
+
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+)
+
+// callUpstream 调用上游并按配置重试。只在向下游写出任何内容之前调用，
+// 匿名token模式下每次尝试都会重新获取token。返回的非200响应由调用方处理，
+// attempts 为实际尝试次数。
+func (h *Handler) callUpstream(ctx context.Context, upstreamReq model.UpstreamRequest, chatID string) (resp *http.Response, attempts int, err error) {
+	policy := h.cfg.Retry
+	attempt := 1
+	for ; ; attempt++ {
+		resp, err = h.upstream.CallUpstreamWithHeaders(ctx, upstreamReq, chatID, h.authToken(ctx))
+		if attempt >= policy.MaxAttempts || clientGone(ctx) || !h.retryable(resp, err) {
+			break
+		}
+
+		wait := backoff(attempt, policy.InitialBackoff.Std(), policy.MaxBackoff.Std())
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			// 丢弃错误响应体以便复用连接
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		metrics.UpstreamRetries.Inc(metrics.Endpoint(ctx))
+		slog.WarnContext(ctx, "上游失败，稍后重试", "chat_id", chatID, "wait", wait,
+			"attempt", attempt+1, "max_attempts", policy.MaxAttempts, "reason", reason)
+
+		select {
+		case <-ctx.Done():
+			return nil, attempt, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return resp, attempt, err
+}
+
+// retryable 网络错误和配置中的状态码可以重试，客户端主动取消的不重试
+func (h *Handler) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return slices.Contains(h.cfg.Retry.RetryableStatus, resp.StatusCode)
+}
+
+// backoff 指数退避加抖动：第n次重试等待 [d/2, d]，d = initial * 2^(n-1)，不超过max
+func backoff(attempt int, initial, max time.Duration) time.Duration {
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// authToken 选择本次对话使用的token：优先匿名token，失败时回退固定token
+func (h *Handler) authToken(ctx context.Context) string {
+	if !h.cfg.AnonTokenEnabled {
+		return h.cfg.UpstreamToken
+	}
+	t, err := h.upstream.GetAnonymousToken(ctx)
+	if err != nil {
+		metrics.AnonTokenFetches.Inc("failure")
+		slog.DebugContext(ctx, "匿名token获取失败，回退固定token", "error", err)
+		return h.cfg.UpstreamToken
+	}
+	metrics.AnonTokenFetches.Inc("success")
+	slog.DebugContext(ctx, "匿名token获取成功")
+	return t
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrShutdown 服务关闭、等待超时后取消剩余请求时使用的 cause。
+// 与客户端断开不同，此时连接仍在，处理函数需要向客户端输出错误
+var ErrShutdown = errors.New("server shutting down")
+
+var errShuttingDown = &apiError{Status: http.StatusServiceUnavailable, Type: errTypeServer, Code: "server_shutting_down",
+	Message: "Server is shutting down, please retry the request"}
+
+// shuttingDown 请求是否因服务关闭被取消
+func shuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrShutdown)
+}
+
+// canceledError 请求上下文被取消时返回的错误：服务关闭为 *apiError，客户端断开为 ctx.Err()
+func canceledError(ctx context.Context) error {
+	if shuttingDown(ctx) {
+		return errShuttingDown
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"Zai/internal/logging"
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+	"Zai/internal/upstream"
+)
+
+// streamErrors 进程启动以来上游流异常中断的次数
+var streamErrors atomic.Int64
+
+// 单行SSE数据的最大长度
+const maxSSELine = 4 << 20
+
+// readUpstream 逐行读取上游SSE，把每个数据事件交给 handle，直到收到done信号。
+// 正常结束返回nil；下游断开返回 ctx.Err()；上游错误事件、读取失败、未收到done就结束或服务关闭时返回 *apiError。
+func (h *Handler) readUpstream(ctx context.Context, body io.Reader, chatID string, handle func(data *model.UpstreamData)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxSSELine)
+	lineCount := 0
+
+	// 上游耗时与输出字数按请求的路由和模型计入指标
+	start, timed := upstream.StartTime(body)
+	endpoint, modelName := metrics.Endpoint(ctx), metrics.Model(ctx)
+	gotFirst := false
+	chars := map[string]int{}
+	defer func() {
+		if timed {
+			metrics.UpstreamDuration.Observe(time.Since(start).Seconds(), endpoint)
+		}
+		for phase, n := range chars {
+			metrics.OutputChars.Add(float64(n), endpoint, modelName, phase)
+		}
+	}()
+
+	slog.DebugContext(ctx, "开始读取上游SSE流", "chat_id", chatID)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return canceledError(ctx)
+		}
+		line := scanner.Text()
+		lineCount++
+
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		dataStr := strings.TrimPrefix(line, "data: ")
+		if dataStr == "" {
+			continue
+		}
+
+		logging.Content(ctx, "收到SSE数据", "line", lineCount, "data", dataStr)
+
+		var upstreamData model.UpstreamData
+		if err := json.Unmarshal([]byte(dataStr), &upstreamData); err != nil {
+			slog.DebugContext(ctx, "SSE数据解析失败", "line", lineCount, "error", err)
+			continue
+		}
+
+		if errObj := upstreamData.Err(); errObj != nil {
+			return h.streamFailure(ctx, chatID, h.upstreamEventError(errObj),
+				fmt.Sprintf("上游错误事件 code=%d detail=%s", errObj.Code, errObj.Detail))
+		}
+
+		slog.DebugContext(ctx, "解析SSE数据", "type", upstreamData.Type, "phase", upstreamData.Data.Phase,
+			"delta_len", len(upstreamData.Data.DeltaContent), "done", upstreamData.Data.Done)
+
+		if delta := upstreamData.Data.DeltaContent; delta != "" {
+			if !gotFirst && timed {
+				metrics.UpstreamFirstToken.Observe(time.Since(start).Seconds(), endpoint)
+			}
+			gotFirst = true
+			phase := "answer"
+			if upstreamData.Data.Phase == "thinking" {
+				phase = "thinking"
+			}
+			chars[phase] += utf8.RuneCountInString(delta)
+		}
+
+		handle(&upstreamData)
+
+		if upstreamData.Finished() {
+			slog.DebugContext(ctx, "检测到流结束信号", "lines", lineCount)
+			return nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return canceledError(ctx)
+	}
+	if err := scanner.Err(); err != nil {
+		return h.streamFailure(ctx, chatID, h.upstreamCallError(err), fmt.Sprintf("读取失败(第%d行): %v", lineCount, err))
+	}
+	return h.streamFailure(ctx, chatID, &apiError{
+		Status:  http.StatusBadGateway,
+		Type:    errTypeUpstream,
+		Code:    "upstream_incomplete",
+		Message: "Upstream stream ended before completion",
+	}, fmt.Sprintf("未收到结束信号(共%d行)", lineCount))
+}
+
+// streamFailure 记录一次上游流中断并计数
+func (h *Handler) streamFailure(ctx context.Context, chatID string, e *apiError, cause string) *apiError {
+	n := streamErrors.Add(1)
+	metrics.StreamErrors.Inc(metrics.Endpoint(ctx), e.Code)
+	slog.WarnContext(ctx, "上游流中断", "chat_id", chatID, "code", e.Code, "received", n, "cause", cause)
+	return e
+}
+
+func writeSSEChunk(w http.ResponseWriter, chunk model.OpenAIResponse) {
+	data, _ := json.Marshal(chunk)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+// writeSSEError 流中的错误事件，格式与HTTP错误体一致：data: {"error":{...}}
+func writeSSEError(w http.ResponseWriter, e *apiError) {
+	data, _ := json.Marshal(e.body())
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"strings"
+
+	"Zai/internal/util"
+)
+
+// stopFilter 在输出中截断到第一个stop序列。stop可能跨chunk出现，
+// 末尾可能是stop前缀的部分先保留，等后续内容到达再决定是否输出
+type stopFilter struct {
+	stops   []string
+	pending string
+	stopped bool
+	matched string // 命中的stop序列
+}
+
+func newStopFilter(stops []string) *stopFilter {
+	f := &stopFilter{}
+	for _, s := range stops {
+		if s != "" {
+			f.stops = append(f.stops, s)
+		}
+	}
+	return f
+}
+
+// Feed 返回可以安全输出的文本。命中stop后只返回stop之前的部分，之后的输入全部丢弃
+func (f *stopFilter) Feed(s string) string {
+	if f.stopped {
+		return ""
+	}
+	if len(f.stops) == 0 {
+		return s
+	}
+	buf := f.pending + s
+	cut := -1
+	for _, stop := range f.stops {
+		if i := strings.Index(buf, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+			f.matched = stop
+		}
+	}
+	if cut >= 0 {
+		f.stopped = true
+		f.pending = ""
+		return buf[:cut]
+	}
+
+	hold := 0
+	for _, stop := range f.stops {
+		hold = max(hold, util.PartialSuffix(buf, stop))
+	}
+	f.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold]
+}
+
+// Flush 上游结束时返回保留的尾部
+func (f *stopFilter) Flush() string {
+	p := f.pending
+	f.pending = ""
+	return p
+}
+
+// Stopped 是否已命中stop序列
+func (f *stopFilter) Stopped() bool {
+	return f.stopped
+}
+
+// Matched 命中的stop序列，未命中时为空
+func (f *stopFilter) Matched() string {
+	return f.matched
+}
+
+// answerFilter 按 stop 序列和 max_tokens 截断回答文本，用于上游忽略这两个参数的情况。
+// 截断后取消该choice的上游请求
+type answerFilter struct {
+	cc    choiceContext
+	stop  *stopFilter
+	limit *lengthLimit
+}
+
+func newAnswerFilter(cc choiceContext, stops []string, maxTokens int) *answerFilter {
+	return &answerFilter{cc: cc, stop: newStopFilter(stops), limit: newLengthLimit(maxTokens)}
+}
+
+// Feed 返回可以输出的回答文本，截断后取消上游请求
+func (a *answerFilter) Feed(s string) string {
+	out := a.limit.Feed(a.stop.Feed(s))
+	if a.stop.Stopped() || a.limit.Reached() {
+		a.cc.finish()
+	}
+	return out
+}
+
+// Flush 上游结束时输出保留的尾部
+func (a *answerFilter) Flush() string {
+	return a.limit.Feed(a.stop.Flush())
+}
+
+// result 上游读取的结果，因截断而取消时按正常结束处理
+func (a *answerFilter) result(err error) error {
+	if a.cc.finished() {
+		return nil
+	}
+	return err
+}
+
+// Stopped 是否命中了stop序列
+func (a *answerFilter) Stopped() bool {
+	return a.stop.Stopped()
+}
+
+// Matched 命中的stop序列，未命中时为空
+func (a *answerFilter) Matched() string {
+	return a.stop.Matched()
+}
+
+// Reached 是否因 max_tokens 截断
+func (a *answerFilter) Reached() bool {
+	return a.limit.Reached()
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"Zai/internal/auth"
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+	"Zai/internal/util"
+)
+
+// suffixInstruction 上游没有原生的插入补全，suffix 通过system指令表达
+const suffixInstruction = "Continue the user's text. Output only the continuation, without repeating the given text. " +
+	"The continuation must fit naturally before the following suffix, and must not include the suffix itself:\n"
+
+// HandleCompletions 旧版文本补全接口（POST /v1/completions）。
+// 每个prompt作为一条user消息走同一条上游路径，思考内容不输出
+func (h *Handler) HandleCompletions(w http.ResponseWriter, r *http.Request) {
+	util.SetCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	key, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	ctx := auth.WithKey(r.Context(), key)
+
+	var req model.CompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.DebugContext(ctx, "JSON解析失败", "error", err)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "invalid_json", "", "Invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Model == "" {
+		req.Model = h.cfg.ModelName
+	}
+	modelCfg, apiErr := h.checkModel(ctx, key, req.Model)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	if len(req.Prompt) == 0 {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "missing_required_parameter", "prompt", "prompt is required")
+		return
+	}
+	params, maxTokens, apiErr := completionParams(&req)
+	if apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+
+	var flusher http.Flusher
+	if req.Stream {
+		if flusher, ok = w.(http.Flusher); !ok {
+			writeError(w, http.StatusInternalServerError, errTypeServer, "streaming_unsupported", "", "Streaming unsupported")
+			return
+		}
+	}
+
+	id := fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+	slog.InfoContext(ctx, "completion", "model", req.Model, "stream", req.Stream, "prompts", len(req.Prompt), "echo", req.Echo, "suffix", req.Suffix != "")
+
+	sendChunk := func(choice model.CompletionChoice) {
+		data, _ := json.Marshal(model.CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []model.CompletionChoice{choice},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	// 多个prompt依次调用上游，流式时按 index 区分
+	var total model.Usage
+	choices := make([]model.CompletionChoice, 0, len(req.Prompt))
+	// 每个prompt单独的上游上下文，回答被截断后立即取消上游请求
+	ccs := newChoiceContexts(ctx, len(req.Prompt))
+	defer cancelAll(ccs)
+	started := false
+	for i, prompt := range req.Prompt {
+		var messages []model.UpstreamMessage
+		if req.Suffix != "" {
+			messages = append(messages, model.UpstreamMessage{Role: "system", Content: suffixInstruction + req.Suffix})
+		}
+		messages = append(messages, model.UpstreamMessage{Role: "user", Content: prompt})
+		upstreamReq := h.newUpstreamRequest(modelCfg, messages, params)
+
+		var text strings.Builder
+		emit := func(s string) {
+			if req.Stream {
+				sendChunk(model.CompletionChoice{Text: s, Index: i})
+				return
+			}
+			text.WriteString(s)
+		}
+
+		cc := ccs[i]
+		resp, err := h.openUpstream(cc, w, upstreamReq)
+		var apiErr *apiError
+		if err != nil && !errors.As(err, &apiErr) {
+			return
+		}
+		finishReason := "stop"
+		if apiErr == nil {
+			if req.Stream && !started {
+				metrics.MarkStream(ctx)
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("Connection", "keep-alive")
+				started = true
+			}
+			if req.Echo {
+				emit(prompt)
+			}
+			var u *model.Usage
+			u, finishReason, err = h.readCompletion(cc, resp, upstreamReq.ChatID, req.Stop, maxTokens, emit)
+			if clientGone(ctx) {
+				logCanceled(ctx, upstreamReq.ChatID, "completions")
+				return
+			}
+			errors.As(err, &apiErr)
+			total.PromptTokens += u.PromptTokens
+			total.CompletionTokens += u.CompletionTokens
+			total.TotalTokens += u.TotalTokens
+		}
+
+		if apiErr != nil {
+			if !started {
+				writeAPIError(w, apiErr)
+				return
+			}
+			// 上游中途出错：finish_reason 为 error，随后发送错误事件
+			finishReason = "error"
+			sendChunk(model.CompletionChoice{Index: i, FinishReason: &finishReason})
+			writeSSEError(w, apiErr)
+			fmt.Fprintf(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			return
+		}
+
+		if req.Stream {
+			sendChunk(model.CompletionChoice{Index: i, FinishReason: &finishReason})
+		} else {
+			choices = append(choices, model.CompletionChoice{Text: text.String(), Index: i, FinishReason: &finishReason})
+		}
+	}
+
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(model.CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: choices,
+			Usage:   &total,
+		})
+		return
+	}
+
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		data, _ := json.Marshal(model.CompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []model.CompletionChoice{},
+			Usage:   &total,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// readCompletion 读取一次上游回答，先按stop、再按 max_tokens 截断后交给 emit，
+// 返回该次调用的usage和 finish_reason（stop 或 length）。截断后立即取消上游请求
+func (h *Handler) readCompletion(cc choiceContext, resp *http.Response, chatID string, stops []string, maxTokens int, emit func(string)) (*model.Usage, string, error) {
+	defer resp.Body.Close()
+	filter := newStopFilter(stops)
+	limit := newLengthLimit(maxTokens)
+	var usage usageTracker
+	err := h.readUpstream(cc, resp.Body, chatID, func(data *model.UpstreamData) {
+		usage.observe(data)
+		if data.Data.Phase == "thinking" || data.Data.DeltaContent == "" {
+			return
+		}
+		if out := limit.Feed(filter.Feed(data.Data.DeltaContent)); out != "" {
+			emit(out)
+		}
+		if filter.Stopped() || limit.Reached() {
+			cc.finish()
+		}
+	})
+	if cc.finished() {
+		err = nil
+	}
+	if err == nil {
+		if out := limit.Feed(filter.Flush()); out != "" {
+			emit(out)
+		}
+	}
+	finishReason := "stop"
+	if limit.Reached() {
+		finishReason = "length"
+	}
+	u := usage.usage()
+	logUsage(cc, chatID, u)
+	return u, finishReason, err
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"strings"
+	"unicode"
+
+	"Zai/internal/util"
+)
+
+// maxTagLen 等待标签闭合的最大长度，超过后按普通文本输出
+const maxTagLen = 256
+
+// thinkFilter 逐段清理上游thinking内容中的标签，mode 为 strip / think / raw：
+//   - <summary>…</summary> 整段丢弃，</thinking>、<Full>、</Full> 删除
+//   - <details …>、</details> 在 think 模式下换成 <think>、</think>，strip 模式下删除，raw 模式保留
+//   - 行首的引用前缀 "> " 删除
+//
+// 标签和前缀可能被拆在两个SSE事件里，无法判断的尾部先保留，等后续内容到达再处理。
+// 整段thinking开头的空白去掉；结尾的空白要等后面出现内容才输出，Flush 时丢弃
+type thinkFilter struct {
+	mode      string
+	pending   string // 可能是未完成标签或引用前缀的尾部
+	inSummary bool   // 位于 <summary> 内，内容丢弃
+	lineStart bool   // 当前位置在行首（只隔着空格或制表符）
+	started   bool   // 已输出过非空白内容
+	space     string // 暂缓输出的结尾空白
+}
+
+func newThinkFilter(mode string) *thinkFilter {
+	return &thinkFilter{mode: mode, lineStart: true}
+}
+
+// Feed 返回可以安全输出的清理后文本
+func (f *thinkFilter) Feed(s string) string {
+	buf := f.pending + s
+	f.pending = ""
+	var out strings.Builder
+	i := 0
+	for i < len(buf) {
+		if f.inSummary {
+			end := strings.Index(buf[i:], "</summary>")
+			if end < 0 {
+				// 丢弃summary内容，只保留可能是结束标签开头的部分
+				rest := buf[i:]
+				f.pending = rest[len(rest)-util.PartialSuffix(rest, "</summary>"):]
+				break
+			}
+			i += end + len("</summary>")
+			f.inSummary = false
+			continue
+		}
+
+		c := buf[i]
+		if c == '>' && f.lineStart {
+			if i+1 == len(buf) {
+				f.pending = buf[i:]
+				break
+			}
+			if buf[i+1] == ' ' {
+				f.lineStart = false
+				i += 2
+				continue
+			}
+		}
+		if c == '<' {
+			if end := strings.IndexByte(buf[i:], '>'); end >= 0 {
+				tag := buf[i : i+end+1]
+				if repl, ok := f.replaceTag(tag); ok {
+					if repl != "" {
+						out.WriteString(repl)
+						f.lineStart = false
+					}
+					i += len(tag)
+					continue
+				}
+			} else if maybeThinkTag(buf[i:]) {
+				f.pending = buf[i:]
+				break
+			}
+		}
+		switch c {
+		case '\n':
+			f.lineStart = true
+		case ' ', '\t':
+		default:
+			f.lineStart = false
+		}
+		out.WriteByte(c)
+		i++
+	}
+	return f.trim(out.String())
+}
+
+// Flush thinking结束时调用，输出保留的尾部（未闭合的标签按原文输出），丢弃结尾空白
+func (f *thinkFilter) Flush() string {
+	rest := ""
+	if !f.inSummary {
+		rest = f.pending
+	}
+	f.pending = ""
+	f.inSummary = false
+	out := f.trim(rest)
+	f.space = ""
+	f.lineStart = true
+	return out
+}
+
+// replaceTag 返回完整标签的替换结果，ok 为false表示不是需要处理的标签
+func (f *thinkFilter) replaceTag(tag string) (string, bool) {
+	switch thinkTagName(tag) {
+	case "summary":
+		f.inSummary = !strings.HasSuffix(tag, "/>")
+		return "", true
+	case "/summary", "/thinking", "Full", "/Full":
+		return "", true
+	case "details":
+		switch f.mode {
+		case "think":
+			return "<think>", true
+		case "strip":
+			return "", true
+		}
+		return tag, true
+	case "/details":
+		switch f.mode {
+		case "think":
+			return "</think>", true
+		case "strip":
+			return "", true
+		}
+		return tag, true
+	}
+	return "", false
+}
+
+// trim 去掉整段开头的空白，结尾空白留到下一次有内容时再输出
+func (f *thinkFilter) trim(s string) string {
+	if !f.started {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return ""
+		}
+		f.started = true
+	}
+	s = f.space + s
+	body := strings.TrimRightFunc(s, unicode.IsSpace)
+	f.space = s[len(body):]
+	return body
+}
+
+// thinkTagName 取 "<name ...>" 中的标签名，结束标签带前导 "/"
+func thinkTagName(tag string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(tag, "<"), ">")
+	prefix := ""
+	if strings.HasPrefix(name, "/") {
+		prefix, name = "/", name[1:]
+	}
+	if i := strings.IndexAny(name, " \t\n/"); i >= 0 {
+		name = name[:i]
+	}
+	return prefix + name
+}
+
+// thinkTags 需要处理的标签名
+var thinkTags = []string{"details", "/details", "summary", "/summary", "/thinking", "Full", "/Full"}
+
+// maybeThinkTag s 以 "<" 开头且尚未闭合，判断它是否可能是需要处理的标签
+func maybeThinkTag(s string) bool {
+	if len(s) > maxTagLen {
+		return false
+	}
+	name := s[1:]
+	for _, t := range thinkTags {
+		if strings.HasPrefix(t, name) {
+			return true
+		}
+		// 标签名已完整，后面是属性
+		if strings.HasPrefix(name, t) && strings.ContainsAny(name[len(t):len(t)+1], " \t\n/") {
+			return true
+		}
+	}
+	return false
+}
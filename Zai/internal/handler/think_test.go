@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"Zai/internal/model"
+	"Zai/internal/upstream/upstreamtest"
+)
+
+// feedAll 依次送入各片段并在最后 Flush，返回拼接后的输出
+func feedAll(mode string, chunks ...string) string {
+	f := newThinkFilter(mode)
+	var out strings.Builder
+	for _, c := range chunks {
+		out.WriteString(f.Feed(c))
+	}
+	out.WriteString(f.Flush())
+	return out.String()
+}
+
+func TestThinkFilter(t *testing.T) {
+	const full = "<details type=\"reasoning\" done=\"false\">\n<summary>Thinking…</summary>\n> 先想 一想\n> \n> 再 回答</thinking><Full>\n</details>\n"
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"strip", "先想 一想\n\n再 回答"},
+		{"think", "<think>\n\n先想 一想\n\n再 回答\n</think>"},
+		{"raw", "<details type=\"reasoning\" done=\"false\">\n\n先想 一想\n\n再 回答\n</details>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if got := feedAll(tt.mode, full); got != tt.want {
+				t.Errorf("整段输入 = %q, want %q", got, tt.want)
+			}
+			// 在每个字节位置切成两段，结果必须与整段输入相同
+			for i := 1; i < len(full); i++ {
+				if got := feedAll(tt.mode, full[:i], full[i:]); got != tt.want {
+					t.Fatalf("在第%d字节切分 = %q, want %q", i, got, tt.want)
+				}
+			}
+			// 逐字节输入
+			var bytes []string
+			for i := 0; i < len(full); i++ {
+				bytes = append(bytes, full[i:i+1])
+			}
+			if got := feedAll(tt.mode, bytes...); got != tt.want {
+				t.Errorf("逐字节输入 = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThinkFilterKeepsWhitespaceBetweenChunks(t *testing.T) {
+	if got := feedAll("strip", "> Let me", " think", " about\n", "> it "); got != "Let me think about\nit" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestThinkFilterPlainText(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"不是标签的尖括号", []string{"a < b 且 c > d"}, "a < b 且 c > d"},
+		{"其他标签保留", []string{"用 <code>x</code> 表示"}, "用 <code>x</code> 表示"},
+		{"行中的大于号", []string{"x >", " y"}, "x > y"},
+		{"未闭合的标签", []string{"结尾 <det"}, "结尾 <det"},
+		{"未闭合的summary丢弃", []string{"内容<summary>Thinking"}, "内容"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := feedAll("strip", tt.chunks...); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 标签跨SSE事件拆分时，流式与非流式都不能泄漏标签
+func TestChatThinkingTagsSplitAcrossEvents(t *testing.T) {
+	script := upstreamtest.Script{Lines: []string{
+		upstreamtest.Thinking("<deta"),
+		upstreamtest.Thinking("ils type=\"reasoning\">\n<sum"),
+		upstreamtest.Thinking("mary>Thinking…</summ"),
+		upstreamtest.Thinking("ary>\n>"),
+		upstreamtest.Thinking(" 第一步"),
+		upstreamtest.Thinking(" 第二步\n</det"),
+		upstreamtest.Thinking("ails>\n"),
+		upstreamtest.Answer("答案"),
+		upstreamtest.Done(&model.Usage{PromptTokens: 1, CompletionTokens: 2, TotalTokens: 3}),
+	}}
+
+	t.Run("stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doChat(t, h, `{"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+		assertEvents(t, rec.Body.String(),
+			chunk(`{"role":"assistant"}`, ""),
+			chunk(`{"reasoning_content":"第一步"}`, ""),
+			chunk(`{"reasoning_content":" 第二步"}`, ""),
+			chunk(`{"content":"答案"}`, ""),
+			chunk(`{}`, "stop"),
+			"[DONE]",
+		)
+	})
+	t.Run("non-stream", func(t *testing.T) {
+		h, up := newTestHandler(t, nil)
+		up.Enqueue(script)
+		rec := doChat(t, h, `{"reasoning_mode":"think","messages":[{"role":"user","content":"hi"}]}`)
+		got := normalize(t, rec.Body.String())
+		want := normalize(t, `{"id":"","object":"chat.completion","created":0,"model":"GLM-4.5",
+			"choices":[{"index":0,"message":{"role":"assistant","content":"<think>\n\n第一步 第二步\n</think>答案"},"delta":{},"finish_reason":"stop"}],
+			"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3,"completion_tokens_details":{"reasoning_tokens":1}}}`)
+		if got != want {
+			t.Errorf("响应不一致\n got: %s\nwant: %s", got, want)
+		}
+	})
+}
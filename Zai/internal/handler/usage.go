@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"unicode/utf8"
+
+	"Zai/internal/metrics"
+	"Zai/internal/model"
+)
+
+// usageTracker 记录上游返回的usage以及thinking/answer的字数
+type usageTracker struct {
+	upstream      *model.Usage
+	thinkingChars int
+	answerChars   int
+}
+
+func (t *usageTracker) observe(data *model.UpstreamData) {
+	if u := data.Data.Usage; u != nil && (u.PromptTokens > 0 || u.CompletionTokens > 0 || u.TotalTokens > 0) {
+		t.upstream = u
+	}
+	n := utf8.RuneCountInString(data.Data.DeltaContent)
+	if data.Data.Phase == "thinking" {
+		t.thinkingChars += n
+	} else {
+		t.answerChars += n
+	}
+}
+
+// usage 返回最终usage。上游没有单独给出reasoning tokens时，
+// 按thinking与answer的字数比例从completion_tokens中拆分
+func (t *usageTracker) usage() *model.Usage {
+	var u model.Usage
+	if t.upstream != nil {
+		u = *t.upstream
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	if u.CompletionTokensDetails == nil {
+		details := &model.CompletionTokensDetails{}
+		if total := t.thinkingChars + t.answerChars; total > 0 {
+			details.ReasoningTokens = u.CompletionTokens * t.thinkingChars / total
+		}
+		u.CompletionTokensDetails = details
+	}
+	return &u
+}
+
+// logUsage 按key记录每次调用的用量，同时计入 token 指标
+func logUsage(ctx context.Context, chatID string, u *model.Usage) {
+	endpoint, modelName := metrics.Endpoint(ctx), metrics.Model(ctx)
+	metrics.Tokens.Add(float64(u.PromptTokens), endpoint, modelName, "prompt")
+	metrics.Tokens.Add(float64(u.CompletionTokens), endpoint, modelName, "completion")
+	metrics.Tokens.Add(float64(u.CompletionTokensDetails.ReasoningTokens), endpoint, modelName, "reasoning")
+	slog.InfoContext(ctx, "usage", "chat_id", chatID, "prompt", u.PromptTokens, "completion", u.CompletionTokens,
+		"reasoning", u.CompletionTokensDetails.ReasoningTokens, "total", u.TotalTokens)
+}
+
+// mergeUsage 合并 n 个choice的usage：与 OpenAI 一致，prompt只计一次，completion和reasoning相加。
+// 打开失败的choice为nil，跳过
+func mergeUsage(usages []*model.Usage) *model.Usage {
+	var merged *model.Usage
+	for _, u := range usages {
+		if u == nil {
+			continue
+		}
+		if merged == nil {
+			c := *u
+			details := *u.CompletionTokensDetails
+			c.CompletionTokensDetails = &details
+			merged = &c
+			continue
+		}
+		merged.PromptTokens = max(merged.PromptTokens, u.PromptTokens)
+		merged.CompletionTokens += u.CompletionTokens
+		merged.CompletionTokensDetails.ReasoningTokens += u.CompletionTokensDetails.ReasoningTokens
+		merged.TotalTokens = merged.PromptTokens + merged.CompletionTokens
+	}
+	if merged == nil {
+		return (&usageTracker{}).usage()
+	}
+	return merged
+}
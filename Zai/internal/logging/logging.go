@@ -0,0 +1,94 @@
+// Package logging 基于 log/slog 的结构化日志：请求ID、key名称自动附加到每条日志，
+// 敏感信息在输出前统一脱敏
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+
+	"Zai/internal/auth"
+	"Zai/internal/config"
+)
+
+var contentEnabled bool
+
+// Setup 按配置设置默认logger，标准库 log 的输出也会经过同一个handler
+func Setup(cfg *config.Config) {
+	level := slog.LevelInfo
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+	if cfg.DebugMode {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var h slog.Handler
+	if cfg.Log.Format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	contentEnabled = cfg.Log.Content
+	slog.SetDefault(slog.New(contextHandler{h}))
+}
+
+// Content 记录消息内容（请求体、SSE数据等）。需要单独开启 log.content，与日志级别无关
+func Content(ctx context.Context, msg string, args ...any) {
+	if contentEnabled {
+		slog.InfoContext(ctx, msg, args...)
+	}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID 把请求ID放入上下文
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID 返回上下文中的请求ID，不存在时为空
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// contextHandler 从上下文中取出请求ID和key名称附加到日志
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := RequestID(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if k := auth.KeyFromContext(ctx); k != nil {
+			r.AddAttrs(slog.String("key", k.Name))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys 这些属性名的值整体替换
+var sensitiveKeys = map[string]bool{
+	"authorization":  true,
+	"api_key":        true,
+	"apikey":         true,
+	"x-api-key":      true,
+	"token":          true,
+	"auth_token":     true,
+	"upstream_token": true,
+	"default_key":    true,
+	"password":       true,
+	"secret":         true,
+	"cookie":         true,
+}
+
+// secretPatterns 出现在任意文本中的凭据
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+	{regexp.MustCompile(`sk-[A-Za-z0-9_-]{8,}`), "sk-" + redacted},
+	{regexp.MustCompile(`(?i)("(?:token|api_key|apikey|authorization|password|secret|default_key|upstream_token)"\s*:\s*")[^"]*`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)([?&](?:key|token)=)[^&\s]+`), "${1}" + redacted},
+}
+
+// Redact 替换文本中的token、API key等凭据
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(Redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(Redact(err.Error()))
+		}
+	}
+	return a
+}
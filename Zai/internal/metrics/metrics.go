@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 延迟分桶：覆盖从几百毫秒的首字到数分钟的长思考
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+var (
+	Requests = NewCounterVec("zai_requests_total",
+		"下游请求数", "endpoint", "model", "key", "status")
+	InFlight = NewGaugeVec("zai_requests_in_flight",
+		"正在处理的下游请求数", "endpoint")
+	UpstreamFirstToken = NewHistogramVec("zai_upstream_first_token_seconds",
+		"发出上游请求到收到第一段内容的耗时", latencyBuckets, "endpoint")
+	UpstreamDuration = NewHistogramVec("zai_upstream_duration_seconds",
+		"发出上游请求到上游流结束的总耗时", latencyBuckets, "endpoint")
+	StreamDuration = NewHistogramVec("zai_stream_duration_seconds",
+		"流式响应从收到请求到结束的时长", latencyBuckets, "endpoint", "model")
+	OutputChars = NewCounterVec("zai_output_characters_total",
+		"上游输出的字符数，phase 为 thinking 或 answer", "endpoint", "model", "phase")
+	Tokens = NewCounterVec("zai_tokens_total",
+		"上游返回的 token 用量，type 为 prompt、completion 或 reasoning", "endpoint", "model", "type")
+	AnonTokenFetches = NewCounterVec("zai_anon_token_fetch_total",
+		"获取匿名 token 的次数，result 为 success 或 failure", "result")
+	UpstreamRetries = NewCounterVec("zai_upstream_retries_total",
+		"上游请求重试次数", "endpoint")
+	StreamErrors = NewCounterVec("zai_upstream_stream_errors_total",
+		"上游流异常中断次数", "endpoint", "code")
+)
+
+// requestInfo 中间件放入上下文的请求标签，由处理函数在鉴权、解析后补全
+type requestInfo struct {
+	endpoint string
+	model    string
+	key      string
+	stream   bool
+}
+
+type requestInfoKey struct{}
+
+func info(ctx context.Context) *requestInfo {
+	if ri, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return ri
+	}
+	return &requestInfo{}
+}
+
+// SetLabels 记录本次请求的key名称和模型
+func SetLabels(ctx context.Context, key, model string) {
+	ri := info(ctx)
+	ri.key = key
+	ri.model = model
+}
+
+// MarkStream 标记为流式响应，结束时计入 zai_stream_duration_seconds
+func MarkStream(ctx context.Context) {
+	info(ctx).stream = true
+}
+
+// Endpoint 返回请求匹配的路由，未经过中间件时为空
+func Endpoint(ctx context.Context) string {
+	return info(ctx).endpoint
+}
+
+// Model 返回 SetLabels 记录的模型
+func Model(ctx context.Context) string {
+	return info(ctx).model
+}
+
+// Middleware 按路由统计请求数、进行中的请求和流式时长。
+// endpoint 标签取 mux 中注册的路由，避免路径参数导致标签基数失控
+func Middleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, endpoint := mux.Handler(r)
+		ri := &requestInfo{endpoint: endpoint}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, ri)
+
+		InFlight.Inc(endpoint)
+		defer InFlight.Dec(endpoint)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		mux.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		Requests.Inc(endpoint, ri.model, ri.key, strconv.Itoa(rec.status))
+		if ri.stream {
+			StreamDuration.Observe(time.Since(start).Seconds(), endpoint, ri.model)
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,235 @@
+// Package metrics 以 Prometheus 文本格式暴露运行指标，只依赖标准库
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector 一个指标族，按名称输出 HELP/TYPE 和所有样本
+type collector interface {
+	write(w io.Writer)
+}
+
+var registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func register(c collector) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.collectors = append(registry.collectors, c)
+}
+
+// Handler 输出所有已注册指标
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.mu.Lock()
+		collectors := append([]collector(nil), registry.collectors...)
+		registry.mu.Unlock()
+		for _, c := range collectors {
+			c.write(w)
+		}
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, typ)
+}
+
+// seriesKey 标签值拼接为map的key，数量与声明的标签不一致时直接panic（属于编程错误）
+func (d *desc) seriesKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s 需要 %d 个标签值，实际 %d 个", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString 生成 {a="x",b="y"}，extra 用于直方图的 le 标签
+func (d *desc) labelString(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", d.labels[i], escapeLabel(v))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extra[i], escapeLabel(extra[i+1]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys 输出顺序固定，便于对比抓取结果
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// CounterVec 只增不减的计数器
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*sample
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name, help, labels}, series: map[string]*sample{}}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Add(v float64, labels ...string) {
+	key := c.seriesKey(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &sample{labels: append([]string(nil), labels...)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range sortedKeys(c.series) {
+		s := c.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(s.labels), formatFloat(s.value))
+	}
+}
+
+// GaugeVec 可增可减的当前值
+type GaugeVec struct {
+	CounterVec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{CounterVec{desc: desc{name, help, labels}, series: map[string]*sample{}}}
+	register(g)
+	return g
+}
+
+func (g *GaugeVec) Dec(labels ...string) {
+	g.Add(-1, labels...)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.header(w, "gauge")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, k := range sortedKeys(g.series) {
+		s := g.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(s.labels), formatFloat(s.value))
+	}
+}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64 // 与 buckets 一一对应，非累计
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec 按上界分桶统计的直方图
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSample
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{desc: desc{name, help, labels}, buckets: buckets, series: map[string]*histogramSample{}}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labels ...string) {
+	key := h.seriesKey(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSample{labels: append([]string(nil), labels...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labels, "le", formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(s.labels), s.count)
+	}
+}
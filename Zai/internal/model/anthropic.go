@@ -0,0 +1,130 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Anthropic Messages API 请求结构
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	Messages      []AnthropicMessage `json:"messages"`
+	System        AnthropicContent   `json:"system,omitempty"`
+	MaxTokens     int                `json:"max_tokens"`
+	Stream        bool               `json:"stream,omitempty"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+}
+
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContent 兼容字符串和content block数组两种写法
+type AnthropicContent []AnthropicBlock
+
+type AnthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Signature *string          `json:"signature,omitempty"`
+	Source    *json.RawMessage `json:"source,omitempty"`
+	// tool_result 的内容，可以是字符串或block数组
+	Content   *AnthropicContent `json:"content,omitempty"`
+	ToolUseID string            `json:"tool_use_id,omitempty"`
+}
+
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*c = AnthropicContent{{Type: "text", Text: s}}
+		return nil
+	}
+	var blocks []AnthropicBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// Text 拼接文本block和tool_result中的文本，thinking block不回传给上游
+func (c AnthropicContent) Text() string {
+	var texts []string
+	for _, b := range c {
+		switch b.Type {
+		case "text":
+			texts = append(texts, b.Text)
+		case "tool_result":
+			if b.Content != nil {
+				texts = append(texts, b.Content.Text())
+			}
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// HasImages 是否包含图片block
+func (c AnthropicContent) HasImages() bool {
+	for _, b := range c {
+		if b.Type == "image" {
+			return true
+		}
+		if b.Content != nil && b.Content.HasImages() {
+			return true
+		}
+	}
+	return false
+}
+
+// Anthropic 响应结构
+type AnthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []AnthropicBlock `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        AnthropicUsage   `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Anthropic 流式事件
+type AnthropicStreamEvent struct {
+	Type         string             `json:"type"`
+	Message      *AnthropicResponse `json:"message,omitempty"`
+	Index        *int               `json:"index,omitempty"`
+	ContentBlock interface{}        `json:"content_block,omitempty"` // 需要保留空的 text/thinking 字段，用map构造
+	Delta        *AnthropicDelta    `json:"delta,omitempty"`
+	Usage        *AnthropicUsage    `json:"usage,omitempty"`
+	Error        *AnthropicError    `json:"error,omitempty"`
+}
+
+type AnthropicDelta struct {
+	Type         string  `json:"type,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	Thinking     string  `json:"thinking,omitempty"`
+	StopReason   *string `json:"stop_reason,omitempty"`
+	StopSequence *string `json:"stop_sequence,omitempty"`
+}
+
+// Anthropic 错误结构
+type AnthropicErrorResponse struct {
+	Type  string         `json:"type"`
+	Error AnthropicError `json:"error"`
+}
+
+type AnthropicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,80 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// CompletionRequest 旧版文本补全请求（POST /v1/completions）
+type CompletionRequest struct {
+	Model         string         `json:"model"`
+	Prompt        Prompt         `json:"prompt"`
+	Suffix        string         `json:"suffix,omitempty"`
+	MaxTokens     *int           `json:"max_tokens,omitempty"`
+	Temperature   *float64       `json:"temperature,omitempty"`
+	TopP          *float64       `json:"top_p,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Stop          StopSequences  `json:"stop,omitempty"`
+	Echo          bool           `json:"echo,omitempty"`
+	User          string         `json:"user,omitempty"`
+}
+
+// Prompt 兼容字符串和字符串数组，数组中每个prompt生成一个choice。
+// 上游只接受文本，token数组形式的prompt不支持
+type Prompt []string
+
+func (p *Prompt) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*p = nil
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*p = Prompt{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("prompt must be a string or an array of strings")
+	}
+	*p = list
+	return nil
+}
+
+// StopSequences 兼容单个字符串和字符串数组
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = nil
+		return nil
+	}
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = StopSequences{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("stop must be a string or an array of strings")
+	}
+	*s = list
+	return nil
+}
+
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`      // 不支持，始终为 null
+	FinishReason *string     `json:"finish_reason"` // 流式中间chunk为 null
+}
@@ -0,0 +1,112 @@
+package model
+
+import "encoding/json"
+
+// GeminiRequest Gemini generateContent / streamGenerateContent 请求
+type GeminiRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+	Tools             json.RawMessage         `json:"tools,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"` // user / model
+	Parts []GeminiPart `json:"parts"`
+}
+
+// Text 拼接非思考的文本部分
+func (c GeminiContent) Text() string {
+	var text string
+	for _, p := range c.Parts {
+		if !p.Thought {
+			text += p.Text
+		}
+	}
+	return text
+}
+
+// HasMedia 是否包含图片等非文本输入
+func (c GeminiContent) HasMedia() bool {
+	for _, p := range c.Parts {
+		if p.InlineData != nil || p.FileData != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFunctionParts 是否包含函数调用或函数结果
+func (c GeminiContent) HasFunctionParts() bool {
+	for _, p := range c.Parts {
+		if len(p.FunctionCall) > 0 || len(p.FunctionResponse) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type GeminiPart struct {
+	Text             string          `json:"text"`
+	Thought          bool            `json:"thought,omitempty"`
+	InlineData       *GeminiBlob     `json:"inlineData,omitempty"`
+	FileData         *GeminiFileData `json:"fileData,omitempty"`
+	FunctionCall     json.RawMessage `json:"functionCall,omitempty"`
+	FunctionResponse json.RawMessage `json:"functionResponse,omitempty"`
+}
+
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mimeType"`
+	FileURI  string `json:"fileUri"`
+}
+
+type GeminiGenerationConfig struct {
+	Temperature     *float64              `json:"temperature,omitempty"`
+	TopP            *float64              `json:"topP,omitempty"`
+	TopK            *int                  `json:"topK,omitempty"`
+	MaxOutputTokens *int                  `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string              `json:"stopSequences,omitempty"`
+	CandidateCount  *int                  `json:"candidateCount,omitempty"`
+	ThinkingConfig  *GeminiThinkingConfig `json:"thinkingConfig,omitempty"`
+}
+
+type GeminiThinkingConfig struct {
+	IncludeThoughts *bool `json:"includeThoughts,omitempty"` // 缺省不输出思考内容
+	ThinkingBudget  *int  `json:"thinkingBudget,omitempty"`
+}
+
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate `json:"candidates"`
+	UsageMetadata *GeminiUsage      `json:"usageMetadata,omitempty"`
+	ModelVersion  string            `json:"modelVersion"`
+	ResponseID    string            `json:"responseId"`
+}
+
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+// GeminiUsage candidatesTokenCount 不含思考部分，思考单独计入 thoughtsTokenCount
+type GeminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount   int `json:"thoughtsTokenCount,omitempty"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+type GeminiErrorResponse struct {
+	Error GeminiError `json:"error"`
+}
+
+type GeminiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
@@ -0,0 +1,16 @@
+package model
+
+// HealthResponse /healthz 与 /readyz 的响应
+type HealthResponse struct {
+	Status        string                 `json:"status"` // ok / ready / not_ready
+	UptimeSeconds int64                  `json:"uptime_seconds"`
+	Checks        map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status    string `json:"status"`           // ok / error / skipped
+	Method    string `json:"method,omitempty"` // 上游探测方式：anon_token / connect
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms,omitempty"`
+	CheckedAt int64  `json:"checked_at,omitempty"` // 探测时间（Unix秒），结果在 probe_ttl 内复用
+}
@@ -1,24 +1,71 @@
 package model
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 // OpenAI 请求结构
 type OpenAIRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Model         string          `json:"model"`
+	Messages      []Message       `json:"messages"`
+	Stream        bool            `json:"stream,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	MaxTokens     *int            `json:"max_tokens,omitempty"`
+	Stop          StopSequences   `json:"stop,omitempty"`
+	Tools         []Tool          `json:"tools,omitempty"`
+	StreamOptions *StreamOptions  `json:"stream_options,omitempty"`
+	ToolChoice    json.RawMessage `json:"tool_choice,omitempty"` // "none" / "auto" / "required" / {"type":"function","function":{"name":...}}
+
+	MaxCompletionTokens *int     `json:"max_completion_tokens,omitempty"` // 新版 max_tokens，两者都有时优先
+	PresencePenalty     *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64 `json:"frequency_penalty,omitempty"`
+	N                   *int     `json:"n,omitempty"` // 返回的choice数，每个choice对应一个独立的上游对话
+
+	// 扩展字段：思考内容输出方式，见 config.ThinkTagsMode
+	ReasoningMode string `json:"reasoning_mode,omitempty"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role             string         `json:"role"`
+	Content          MessageContent `json:"content"`
+	ReasoningContent string         `json:"reasoning_content,omitempty"`
+	Name             string         `json:"name,omitempty"`
+	ToolCalls        []ToolCall     `json:"tool_calls,omitempty"`
+	ToolCallID       string         `json:"tool_call_id,omitempty"`
+}
+
+// 工具定义
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// 工具调用（流式时携带Index）
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 // 上游请求结构
 type UpstreamRequest struct {
 	Stream          bool                   `json:"stream"`
 	Model           string                 `json:"model"`
-	Messages        []Message              `json:"messages"`
+	Messages        []UpstreamMessage      `json:"messages"`
 	Params          map[string]interface{} `json:"params"`
 	Features        map[string]interface{} `json:"features"`
 	BackgroundTasks map[string]bool        `json:"background_tasks,omitempty"`
@@ -34,6 +81,16 @@ type UpstreamRequest struct {
 	Variables   map[string]string `json:"variables,omitempty"`
 }
 
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// 上游消息只接受纯文本
+type UpstreamMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
 // OpenAI 响应结构
 type OpenAIResponse struct {
 	ID      string   `json:"id"`
@@ -41,7 +98,7 @@ type OpenAIResponse struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage,omitempty"`
+	Usage   *Usage   `json:"usage,omitempty"`
 }
 
 type Choice struct {
@@ -49,17 +106,27 @@ type Choice struct {
 	Message      Message `json:"message,omitempty"`
 	Delta        Delta   `json:"delta,omitempty"`
 	FinishReason string  `json:"finish_reason,omitempty"`
+
+	// 扩展字段：n > 1 时单个choice失败的原因，此时 finish_reason 为 error
+	Error *ErrorDetail `json:"error,omitempty"`
 }
 
 type Delta struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role             string     `json:"role,omitempty"`
+	Content          string     `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+}
+
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 // 上游SSE响应结构
@@ -69,7 +136,7 @@ type UpstreamData struct {
 		DeltaContent string         `json:"delta_content"`
 		Phase        string         `json:"phase"`
 		Done         bool           `json:"done"`
-		Usage        Usage          `json:"usage,omitempty"`
+		Usage        *Usage         `json:"usage,omitempty"`
 		Error        *UpstreamError `json:"error,omitempty"`
 		Inner        *struct {
 			Error *UpstreamError `json:"error,omitempty"`
@@ -78,11 +145,42 @@ type UpstreamData struct {
 	Error *UpstreamError `json:"error,omitempty"`
 }
 
+// Err 返回事件中携带的错误（data.error、data.data.error 或顶层error），没有则为nil
+func (d *UpstreamData) Err() *UpstreamError {
+	if d.Error != nil {
+		return d.Error
+	}
+	if d.Data.Error != nil {
+		return d.Data.Error
+	}
+	if d.Data.Inner != nil {
+		return d.Data.Inner.Error
+	}
+	return nil
+}
+
+// Finished 是否为结束信号
+func (d *UpstreamData) Finished() bool {
+	return d.Data.Done || d.Data.Phase == "done"
+}
+
 type UpstreamError struct {
 	Detail string `json:"detail"`
 	Code   int    `json:"code"`
 }
 
+// OpenAI 错误响应结构
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
 // 模型列表响应
 type ModelsResponse struct {
 	Object string  `json:"object"`
@@ -95,3 +193,77 @@ type Model struct {
 	Created int64  `json:"created"`
 	OwnedBy string `json:"owned_by"`
 }
+
+// MessageContent 兼容 OpenAI 的字符串和 content-part 数组两种写法
+type MessageContent struct {
+	text  string
+	parts []ContentPart // 非nil表示数组写法
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// TextContent 构造纯文本内容
+func TextContent(s string) MessageContent {
+	return MessageContent{text: s}
+}
+
+// Text 返回拼接后的文本，非文本part会被忽略
+func (c MessageContent) Text() string {
+	if c.parts == nil {
+		return c.text
+	}
+	var texts []string
+	for _, p := range c.parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Images 返回所有图片part（data URL或http URL）
+func (c MessageContent) Images() []ImageURL {
+	var images []ImageURL
+	for _, p := range c.parts {
+		if p.Type == "image_url" && p.ImageURL != nil {
+			images = append(images, *p.ImageURL)
+		}
+	}
+	return images
+}
+
+func (c MessageContent) MarshalJSON() ([]byte, error) {
+	if c.parts != nil {
+		return json.Marshal(c.parts)
+	}
+	return json.Marshal(c.text)
+}
+
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	*c = MessageContent{}
+	switch {
+	case string(data) == "null":
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		var parts []ContentPart
+		if err := json.Unmarshal(data, &parts); err != nil {
+			return err
+		}
+		if parts == nil {
+			parts = []ContentPart{}
+		}
+		c.parts = parts
+		return nil
+	default:
+		return json.Unmarshal(data, &c.text)
+	}
+}
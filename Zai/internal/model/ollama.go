@@ -0,0 +1,136 @@
+package model
+
+import "encoding/json"
+
+// OllamaChatRequest Ollama /api/chat 请求。stream 缺省为 true
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream,omitempty"`
+	Think    OllamaThink     `json:"think"`
+	Options  OllamaOptions   `json:"options"`
+	Tools    json.RawMessage `json:"tools,omitempty"`
+}
+
+// OllamaGenerateRequest Ollama /api/generate 请求
+type OllamaGenerateRequest struct {
+	Model   string        `json:"model"`
+	Prompt  string        `json:"prompt"`
+	Suffix  string        `json:"suffix,omitempty"`
+	System  string        `json:"system,omitempty"`
+	Images  []string      `json:"images,omitempty"`
+	Stream  *bool         `json:"stream,omitempty"`
+	Think   OllamaThink   `json:"think"`
+	Options OllamaOptions `json:"options"`
+}
+
+type OllamaMessage struct {
+	Role     string   `json:"role"`
+	Content  string   `json:"content"`
+	Thinking string   `json:"thinking,omitempty"`
+	Images   []string `json:"images,omitempty"`
+}
+
+// OllamaOptions 只处理能映射到上游的采样参数，其余选项忽略
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// OllamaThink 兼容 true/false 和 "high"/"medium"/"low" 写法，未设置时视为开启
+type OllamaThink struct {
+	value *bool
+}
+
+func (t *OllamaThink) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		t.value = &b
+		return nil
+	}
+	var level string
+	if err := json.Unmarshal(data, &level); err != nil {
+		return err
+	}
+	b = level != ""
+	t.value = &b
+	return nil
+}
+
+// Enabled 是否输出思考内容
+func (t OllamaThink) Enabled() bool {
+	return t.value == nil || *t.value
+}
+
+// OllamaStats Ollama 响应结束时的计数与耗时（纳秒）
+type OllamaStats struct {
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalCount    int   `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int   `json:"eval_count,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
+}
+
+type OllamaChatResponse struct {
+	Model      string        `json:"model"`
+	CreatedAt  string        `json:"created_at"`
+	Message    OllamaMessage `json:"message"`
+	Done       bool          `json:"done"`
+	DoneReason string        `json:"done_reason,omitempty"`
+	OllamaStats
+}
+
+type OllamaGenerateResponse struct {
+	Model      string `json:"model"`
+	CreatedAt  string `json:"created_at"`
+	Response   string `json:"response"`
+	Thinking   string `json:"thinking,omitempty"`
+	Done       bool   `json:"done"`
+	DoneReason string `json:"done_reason,omitempty"`
+	OllamaStats
+}
+
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt string             `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+type OllamaModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// OllamaShowRequest 旧版客户端使用 name 字段
+type OllamaShowRequest struct {
+	Model string `json:"model"`
+	Name  string `json:"name"`
+}
+
+type OllamaShowResponse struct {
+	Modelfile    string                 `json:"modelfile"`
+	Parameters   string                 `json:"parameters"`
+	Template     string                 `json:"template"`
+	Details      OllamaModelDetails     `json:"details"`
+	ModelInfo    map[string]interface{} `json:"model_info"`
+	Capabilities []string               `json:"capabilities"`
+	ModifiedAt   string                 `json:"modified_at"`
+}
+
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
+}
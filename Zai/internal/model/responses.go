@@ -0,0 +1,203 @@
+package model
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ResponsesRequest OpenAI Responses API 请求（POST /v1/responses）
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              ResponseInput     `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Stream             bool              `json:"stream,omitempty"`
+	Store              *bool             `json:"store,omitempty"` // 缺省为 true
+	Temperature        *float64          `json:"temperature,omitempty"`
+	TopP               *float64          `json:"top_p,omitempty"`
+	MaxOutputTokens    *int              `json:"max_output_tokens,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// ResponseInput 兼容字符串和输入项数组两种写法，字符串等价于一条 user 消息
+type ResponseInput []ResponseInputItem
+
+func (in *ResponseInput) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*in = nil
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = ResponseInput{{Type: "message", Role: "user", Content: ResponseInputContent{{Type: "input_text", Text: text}}}}
+		return nil
+	}
+	var items []ResponseInputItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*in = items
+	return nil
+}
+
+// ResponseInputItem 输入项。只处理消息，type 缺省时按消息处理
+type ResponseInputItem struct {
+	Type    string               `json:"type,omitempty"`
+	Role    string               `json:"role,omitempty"`
+	Content ResponseInputContent `json:"content,omitempty"`
+}
+
+// ResponseInputContent 兼容字符串和 input_text/output_text/input_image 数组
+type ResponseInputContent []ResponseInputPart
+
+type ResponseInputPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+}
+
+func (c *ResponseInputContent) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*c = nil
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ResponseInputContent{{Type: "input_text", Text: text}}
+		return nil
+	}
+	var parts []ResponseInputPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*c = parts
+	return nil
+}
+
+// Text 拼接所有文本部分
+func (c ResponseInputContent) Text() string {
+	var texts []string
+	for _, p := range c {
+		switch p.Type {
+		case "input_text", "output_text", "text", "refusal":
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// HasImages 是否包含图片输入
+func (c ResponseInputContent) HasImages() bool {
+	for _, p := range c {
+		if p.Type == "input_image" {
+			return true
+		}
+	}
+	return false
+}
+
+// ResponseObject Responses API 的响应对象，也用于 GET /v1/responses/{id}
+type ResponseObject struct {
+	ID                 string            `json:"id"`
+	Object             string            `json:"object"`
+	CreatedAt          int64             `json:"created_at"`
+	Status             string            `json:"status"` // in_progress / completed / failed
+	Model              string            `json:"model"`
+	Instructions       *string           `json:"instructions"`
+	PreviousResponseID *string           `json:"previous_response_id"`
+	Output             []ResponseItem    `json:"output"`
+	Error              *ResponseError    `json:"error"`
+	Usage              *ResponseUsage    `json:"usage"`
+	Store              bool              `json:"store"`
+	Temperature        *float64          `json:"temperature"`
+	TopP               *float64          `json:"top_p"`
+	MaxOutputTokens    *int              `json:"max_output_tokens"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+// ResponseItem 输出项：reasoning（思考内容放在 summary 中）或 message
+type ResponseItem struct {
+	Type    string
+	ID      string
+	Status  string
+	Role    string
+	Content []ResponseContentPart // message 的 output_text，reasoning 的 summary_text
+}
+
+// MarshalJSON 按类型输出字段，空列表输出为 []
+func (it ResponseItem) MarshalJSON() ([]byte, error) {
+	parts := it.Content
+	if parts == nil {
+		parts = []ResponseContentPart{}
+	}
+	if it.Type == "reasoning" {
+		return json.Marshal(struct {
+			Type    string                `json:"type"`
+			ID      string                `json:"id"`
+			Summary []ResponseContentPart `json:"summary"`
+		}{it.Type, it.ID, parts})
+	}
+	return json.Marshal(struct {
+		Type    string                `json:"type"`
+		ID      string                `json:"id"`
+		Status  string                `json:"status"`
+		Role    string                `json:"role"`
+		Content []ResponseContentPart `json:"content"`
+	}{it.Type, it.ID, it.Status, it.Role, parts})
+}
+
+type ResponseContentPart struct {
+	Type string // output_text / summary_text
+	Text string
+}
+
+func (p ResponseContentPart) MarshalJSON() ([]byte, error) {
+	if p.Type == "output_text" {
+		return json.Marshal(struct {
+			Type        string        `json:"type"`
+			Text        string        `json:"text"`
+			Annotations []interface{} `json:"annotations"`
+		}{p.Type, p.Text, []interface{}{}})
+	}
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}{p.Type, p.Text})
+}
+
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ResponseUsage struct {
+	InputTokens         int                         `json:"input_tokens"`
+	InputTokensDetails  ResponseInputTokensDetails  `json:"input_tokens_details"`
+	OutputTokens        int                         `json:"output_tokens"`
+	OutputTokensDetails ResponseOutputTokensDetails `json:"output_tokens_details"`
+	TotalTokens         int                         `json:"total_tokens"`
+}
+
+type ResponseInputTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type ResponseOutputTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+// ResponseStreamEvent Responses API 流式事件，字段按事件类型选用
+type ResponseStreamEvent struct {
+	Type           string               `json:"type"`
+	SequenceNumber int                  `json:"sequence_number"`
+	Response       *ResponseObject      `json:"response,omitempty"`
+	OutputIndex    *int                 `json:"output_index,omitempty"`
+	ItemID         string               `json:"item_id,omitempty"`
+	ContentIndex   *int                 `json:"content_index,omitempty"`
+	SummaryIndex   *int                 `json:"summary_index,omitempty"`
+	Item           *ResponseItem        `json:"item,omitempty"`
+	Part           *ResponseContentPart `json:"part,omitempty"`
+	Delta          string               `json:"delta,omitempty"`
+	Text           *string              `json:"text,omitempty"`
+}
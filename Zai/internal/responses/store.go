@@ -0,0 +1,80 @@
+// Package responses 在内存中保存 Responses API 的结果，
+// 供 GET /v1/responses/{id} 查询以及 previous_response_id 续接对话
+package responses
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"Zai/internal/config"
+	"Zai/internal/model"
+)
+
+// Entry 一条已完成的响应。Messages 是续接时需要重放给上游的完整对话（不含 instructions）
+type Entry struct {
+	Response *model.ResponseObject
+	Messages []model.UpstreamMessage
+	KeyName  string // 只有同一个key可以读取和续接
+
+	expiresAt time.Time
+}
+
+// Store 按写入顺序淘汰的内存存储。所有记录TTL相同，过期的记录总在队首
+type Store struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*Entry
+	order      []string
+}
+
+func NewStore(cfg config.ResponseStoreConfig) *Store {
+	return &Store{
+		maxEntries: cfg.MaxEntries,
+		ttl:        cfg.TTL.Std(),
+		entries:    make(map[string]*Entry),
+	}
+}
+
+// Put 保存一条记录，max_entries 为0时不保存
+func (s *Store) Put(id string, e *Entry) {
+	if s.maxEntries == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.expiresAt = time.Now().Add(s.ttl)
+	s.entries[id] = e
+	s.order = append(s.order, id)
+	s.evictLocked()
+}
+
+// Get 返回未过期的记录。调用方不应修改返回值
+func (s *Store) Get(id string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictLocked()
+	e, ok := s.entries[id]
+	return e, ok
+}
+
+func (s *Store) evictLocked() {
+	now := time.Now()
+	for len(s.order) > 0 {
+		e := s.entries[s.order[0]]
+		if len(s.order) <= s.maxEntries && e.expiresAt.After(now) {
+			break
+		}
+		delete(s.entries, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// NewID 生成带前缀的随机ID，如 resp_xxx
+func NewID(prefix string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return prefix + "_" + hex.EncodeToString(b)
+}
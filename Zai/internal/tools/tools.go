@@ -0,0 +1,286 @@
+package tools
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"Zai/internal/model"
+	"Zai/internal/util"
+)
+
+// 上游不支持原生工具调用，通过提示词约定以下标签格式来模拟
+const (
+	callOpen      = "<tool_call>"
+	callClose     = "</tool_call>"
+	responseOpen  = "<tool_response>"
+	responseClose = "</tool_response>"
+)
+
+// Choice 解析后的 tool_choice
+type Choice struct {
+	Mode string // none / auto / required / function
+	Name string // Mode 为 function 时指定的函数名
+}
+
+// ParseChoice 解析 OpenAI 的 tool_choice 字段，缺省为 auto。指定的函数必须在 defs 中
+func ParseChoice(raw json.RawMessage, defs []model.Tool) (Choice, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return Choice{Mode: "auto"}, nil
+	}
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		switch mode {
+		case "none", "auto", "required":
+			return Choice{Mode: mode}, nil
+		}
+		return Choice{}, fmt.Errorf("unsupported tool_choice %q", mode)
+	}
+	var obj struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil || obj.Type != "function" || obj.Function.Name == "" {
+		return Choice{}, fmt.Errorf("invalid tool_choice")
+	}
+	for _, d := range defs {
+		if d.Function.Name == obj.Function.Name {
+			return Choice{Mode: "function", Name: obj.Function.Name}, nil
+		}
+	}
+	return Choice{}, fmt.Errorf("function %q not found in tools", obj.Function.Name)
+}
+
+// Active 本次请求是否需要注入工具并解析工具调用
+func Active(defs []model.Tool, choice Choice) bool {
+	return len(defs) > 0 && choice.Mode != "none"
+}
+
+// PrepareMessages 把消息转换为上游的纯文本消息：content-part 数组拼接为文本，
+// 历史中的 tool_calls / tool 消息改写为约定的标签格式，并在需要时注入工具定义
+func PrepareMessages(msgs []model.Message, defs []model.Tool, choice Choice) []model.UpstreamMessage {
+	names := make(map[string]string) // tool_call_id -> 函数名
+	out := make([]model.UpstreamMessage, 0, len(msgs)+1)
+	for _, m := range msgs {
+		switch {
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			var b strings.Builder
+			b.WriteString(m.Content.Text())
+			for _, tc := range m.ToolCalls {
+				names[tc.ID] = tc.Function.Name
+				if b.Len() > 0 {
+					b.WriteString("\n")
+				}
+				b.WriteString(renderCall(tc))
+			}
+			out = append(out, model.UpstreamMessage{Role: "assistant", Content: b.String()})
+		case m.Role == "tool":
+			name := m.Name
+			if name == "" {
+				name = names[m.ToolCallID]
+			}
+			block := fmt.Sprintf("%s\n%s\n%s", responseOpen, renderResponse(name, m.ToolCallID, m.Content.Text()), responseClose)
+			// 连续的工具结果合并为一条user消息
+			if n := len(out); n > 0 && out[n-1].Role == "user" && strings.HasSuffix(out[n-1].Content, responseClose) {
+				out[n-1].Content += "\n" + block
+				continue
+			}
+			out = append(out, model.UpstreamMessage{Role: "user", Content: block})
+		default:
+			out = append(out, model.UpstreamMessage{Role: m.Role, Content: m.Content.Text()})
+		}
+	}
+
+	if !Active(defs, choice) {
+		return out
+	}
+	prompt := systemPrompt(defs, choice)
+	if len(out) > 0 && out[0].Role == "system" {
+		out[0].Content = strings.TrimRight(out[0].Content, "\n") + "\n\n" + prompt
+		return out
+	}
+	return append([]model.UpstreamMessage{{Role: "system", Content: prompt}}, out...)
+}
+
+func systemPrompt(defs []model.Tool, choice Choice) string {
+	var b strings.Builder
+	b.WriteString("# Tools\n\nYou may call one or more functions to assist with the user query.\n\n")
+	b.WriteString("You are provided with function signatures within <tools></tools> XML tags:\n<tools>\n")
+	for _, t := range defs {
+		if t.Type == "" {
+			t.Type = "function"
+		}
+		data, _ := json.Marshal(t)
+		b.Write(data)
+		b.WriteString("\n")
+	}
+	b.WriteString("</tools>\n\n")
+	b.WriteString("For each function call, return a json object with function name and arguments within <tool_call></tool_call> XML tags:\n")
+	b.WriteString("<tool_call>\n{\"name\": <function-name>, \"arguments\": <args-json-object>}\n</tool_call>\n\n")
+	b.WriteString("Do not wrap tool calls in code blocks. After the tool calls, stop and wait: results will be provided in <tool_response></tool_response> XML tags.")
+	switch choice.Mode {
+	case "required":
+		b.WriteString("\nYou MUST call at least one function in this reply.")
+	case "function":
+		fmt.Fprintf(&b, "\nYou MUST call the function %q in this reply.", choice.Name)
+	}
+	return b.String()
+}
+
+func renderCall(tc model.ToolCall) string {
+	args := json.RawMessage(tc.Function.Arguments)
+	if !json.Valid(args) {
+		args, _ = json.Marshal(tc.Function.Arguments)
+	}
+	data, _ := json.Marshal(struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}{tc.Function.Name, args})
+	return fmt.Sprintf("%s\n%s\n%s", callOpen, data, callClose)
+}
+
+func renderResponse(name, id, content string) string {
+	data, _ := json.Marshal(struct {
+		Name       string `json:"name,omitempty"`
+		ToolCallID string `json:"tool_call_id,omitempty"`
+	}{name, id})
+	return fmt.Sprintf("%s\n%s", data, content)
+}
+
+// Parser 增量解析模型输出中的 <tool_call> 块，标签可以跨chunk
+type Parser struct {
+	pending string
+	inCall  bool
+	calls   int
+}
+
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+// Called 是否已经解析出至少一个工具调用
+func (p *Parser) Called() bool {
+	return p.calls > 0
+}
+
+// Feed 输入一段回答文本，返回可以立即输出的普通文本和本次解析完成的工具调用
+func (p *Parser) Feed(s string) (string, []model.ToolCall) {
+	p.pending += s
+	var text strings.Builder
+	var calls []model.ToolCall
+	for {
+		if !p.inCall {
+			if idx := strings.Index(p.pending, callOpen); idx >= 0 {
+				p.writeText(&text, p.pending[:idx])
+				p.pending = p.pending[idx+len(callOpen):]
+				p.inCall = true
+				continue
+			}
+			// 保留可能是标签开头的尾部，等待下一个chunk
+			keep := util.PartialSuffix(p.pending, callOpen)
+			p.writeText(&text, p.pending[:len(p.pending)-keep])
+			p.pending = p.pending[len(p.pending)-keep:]
+			break
+		}
+		idx := strings.Index(p.pending, callClose)
+		if idx < 0 {
+			break
+		}
+		body := p.pending[:idx]
+		p.pending = p.pending[idx+len(callClose):]
+		p.inCall = false
+		if tc, ok := p.parseCall(body); ok {
+			calls = append(calls, tc)
+		} else {
+			p.writeText(&text, callOpen+body+callClose)
+		}
+	}
+	return text.String(), calls
+}
+
+// Flush 上游结束时调用，输出剩余内容（容忍缺失的 </tool_call>）
+func (p *Parser) Flush() (string, []model.ToolCall) {
+	var text strings.Builder
+	var calls []model.ToolCall
+	if p.inCall {
+		if tc, ok := p.parseCall(p.pending); ok {
+			calls = append(calls, tc)
+		} else {
+			p.writeText(&text, callOpen+p.pending)
+		}
+	} else {
+		p.writeText(&text, p.pending)
+	}
+	p.pending = ""
+	p.inCall = false
+	return text.String(), calls
+}
+
+// Truncate 回答被 max_tokens 或 stop 截断时代替 Flush 调用。未闭合的工具调用能解析时照常返回，
+// 否则整段丢弃；可能是标签开头的尾部同样丢弃，不把残缺的工具调用标记当作普通文本输出
+func (p *Parser) Truncate() []model.ToolCall {
+	var calls []model.ToolCall
+	if p.inCall {
+		body := p.pending[:len(p.pending)-util.PartialSuffix(p.pending, callClose)]
+		if tc, ok := p.parseCall(body); ok {
+			calls = append(calls, tc)
+		}
+	}
+	p.pending = ""
+	p.inCall = false
+	return calls
+}
+
+// writeText 工具调用之后的空白不再输出
+func (p *Parser) writeText(b *strings.Builder, s string) {
+	if p.calls > 0 && strings.TrimSpace(s) == "" {
+		return
+	}
+	b.WriteString(s)
+}
+
+func (p *Parser) parseCall(body string) (model.ToolCall, bool) {
+	body = strings.TrimSpace(body)
+	body = strings.TrimPrefix(body, "```json")
+	body = strings.Trim(body, "`\n ")
+	var raw struct {
+		Name       string          `json:"name"`
+		Arguments  json.RawMessage `json:"arguments"`
+		Parameters json.RawMessage `json:"parameters"`
+	}
+	if err := json.Unmarshal([]byte(body), &raw); err != nil || raw.Name == "" {
+		return model.ToolCall{}, false
+	}
+	args := raw.Arguments
+	if len(args) == 0 {
+		args = raw.Parameters
+	}
+	arguments := "{}"
+	var str string
+	if len(args) > 0 && json.Unmarshal(args, &str) == nil {
+		arguments = str
+	} else if len(args) > 0 && string(args) != "null" {
+		var buf bytes.Buffer
+		if json.Compact(&buf, args) == nil {
+			arguments = buf.String()
+		}
+	}
+	p.calls++
+	return model.ToolCall{
+		ID:       NewCallID(),
+		Type:     "function",
+		Function: model.FunctionCall{Name: raw.Name, Arguments: arguments},
+	}, true
+}
+
+// NewCallID 生成 OpenAI 风格的工具调用ID
+func NewCallID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
@@ -2,20 +2,56 @@ package upstream
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"Zai/internal/config"
+	"Zai/internal/logging"
 	"Zai/internal/model"
-	"Zai/internal/util"
 )
 
-// GetAnonymousToken 获取匿名token（每次对话使用不同token，避免共享记忆）
-func GetAnonymousToken() (string, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", config.ORIGIN_BASE+"/api/v1/auths/", nil)
+// ErrStreamIdle 上游两次输出之间超过 stream_idle_timeout
+var ErrStreamIdle = errors.New("upstream stream idle timeout")
+
+// Client 上游调用客户端，所有请求共用同一个连接池
+type Client struct {
+	cfg  *config.Config
+	http *http.Client
+}
+
+func NewClient(cfg *config.Config) *Client {
+	t := cfg.Transport
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   t.ConnectTimeout.Std(),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   t.TLSHandshakeTimeout.Std(),
+		ResponseHeaderTimeout: t.FirstByteTimeout.Std(),
+		MaxIdleConns:          t.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		IdleConnTimeout:       t.IdleConnTimeout.Std(),
+	}
+	// 不设置 http.Client.Timeout：总时长不受限，由各阶段超时和流空闲超时控制
+	return &Client{cfg: cfg, http: &http.Client{Transport: transport}}
+}
+
+// GetAnonymousToken 获取匿名token（每次对话使用不同token，避免共享记忆）。
+// 整个请求（含读取响应体）受 token_timeout 限制，避免慢速响应拖住对话请求
+func (c *Client) GetAnonymousToken(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Transport.TokenTimeout.Std())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", c.cfg.OriginBase+"/api/v1/auths/", nil)
 	if err != nil {
 		return "", err
 	}
@@ -27,10 +63,10 @@ func GetAnonymousToken() (string, error) {
 	req.Header.Set("sec-ch-ua", config.SEC_CH_UA)
 	req.Header.Set("sec-ch-ua-mobile", config.SEC_CH_UA_MOB)
 	req.Header.Set("sec-ch-ua-platform", config.SEC_CH_UA_PLAT)
-	req.Header.Set("Origin", config.ORIGIN_BASE)
-	req.Header.Set("Referer", config.ORIGIN_BASE+"/")
+	req.Header.Set("Origin", c.cfg.OriginBase)
+	req.Header.Set("Referer", c.cfg.OriginBase+"/")
 
-	resp, err := client.Do(req)
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -50,19 +86,46 @@ func GetAnonymousToken() (string, error) {
 	return body.Token, nil
 }
 
-func CallUpstreamWithHeaders(upstreamReq model.UpstreamRequest, refererChatID string, authToken string) (*http.Response, error) {
+// Probe 检查上游是否可达：请求上游站点根路径，收到任何非5xx响应即视为可达
+func (c *Client) Probe(ctx context.Context) error {
+	u, err := url.Parse(c.cfg.UpstreamURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.Scheme+"://"+u.Host+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", config.BROWSER_UA)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// CallUpstreamWithHeaders 发起上游请求，ctx 取消（如下游断开）时请求和响应体读取都会中止
+func (c *Client) CallUpstreamWithHeaders(ctx context.Context, upstreamReq model.UpstreamRequest, refererChatID string, authToken string) (*http.Response, error) {
 	reqBody, err := json.Marshal(upstreamReq)
 	if err != nil {
-		util.DebugLog("上游请求序列化失败: %v", err)
+		slog.DebugContext(ctx, "上游请求序列化失败", "error", err)
 		return nil, err
 	}
 
-	util.DebugLog("调用上游API: %s", config.UPSTREAM_URL)
-	util.DebugLog("上游请求体: %s", string(reqBody))
+	slog.DebugContext(ctx, "调用上游API", "url", c.cfg.UpstreamURL, "chat_id", upstreamReq.ChatID)
+	logging.Content(ctx, "上游请求体", "body", string(reqBody))
 
-	req, err := http.NewRequest("POST", config.UPSTREAM_URL, bytes.NewBuffer(reqBody))
+	start := time.Now()
+	ctx, cancel := context.WithCancelCause(ctx)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.UpstreamURL, bytes.NewBuffer(reqBody))
 	if err != nil {
-		util.DebugLog("创建HTTP请求失败: %v", err)
+		cancel(err)
+		slog.DebugContext(ctx, "创建HTTP请求失败", "error", err)
 		return nil, err
 	}
 
@@ -75,16 +138,63 @@ func CallUpstreamWithHeaders(upstreamReq model.UpstreamRequest, refererChatID st
 	req.Header.Set("sec-ch-ua-mobile", config.SEC_CH_UA_MOB)
 	req.Header.Set("sec-ch-ua-platform", config.SEC_CH_UA_PLAT)
 	req.Header.Set("X-FE-Version", config.X_FE_VERSION)
-	req.Header.Set("Origin", config.ORIGIN_BASE)
-	req.Header.Set("Referer", config.ORIGIN_BASE+"/c/"+refererChatID)
+	req.Header.Set("Origin", c.cfg.OriginBase)
+	req.Header.Set("Referer", c.cfg.OriginBase+"/c/"+refererChatID)
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := c.http.Do(req)
 	if err != nil {
-		util.DebugLog("上游请求失败: %v", err)
+		cancel(err)
+		slog.DebugContext(ctx, "上游请求失败", "error", err)
 		return nil, err
 	}
 
-	util.DebugLog("上游响应状态: %d %s", resp.StatusCode, resp.Status)
+	slog.DebugContext(ctx, "上游响应状态", "status", resp.StatusCode)
+	body := newIdleTimeoutBody(ctx, resp.Body, c.cfg.Transport.StreamIdleTimeout.Std(), cancel)
+	body.start = start
+	resp.Body = body
 	return resp, nil
 }
+
+// idleTimeoutBody 两次读取之间超过idle时间即取消请求，读取方收到 ErrStreamIdle
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	idle   time.Duration
+	timer  *time.Timer
+	cancel context.CancelCauseFunc
+	start  time.Time // 上游请求发出的时间
+}
+
+func newIdleTimeoutBody(ctx context.Context, body io.ReadCloser, idle time.Duration, cancel context.CancelCauseFunc) *idleTimeoutBody {
+	return &idleTimeoutBody{
+		ReadCloser: body,
+		ctx:        ctx,
+		idle:       idle,
+		timer:      time.AfterFunc(idle, func() { cancel(ErrStreamIdle) }),
+		cancel:     cancel,
+	}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && errors.Is(context.Cause(b.ctx), ErrStreamIdle) {
+		return n, ErrStreamIdle
+	}
+	b.timer.Reset(b.idle)
+	return n, err
+}
+
+// StartTime 返回响应体对应的上游请求发出时间；body 不是 CallUpstreamWithHeaders 返回的响应体时 ok 为false
+func StartTime(body io.Reader) (start time.Time, ok bool) {
+	if b, isIdle := body.(*idleTimeoutBody); isIdle {
+		return b.start, true
+	}
+	return time.Time{}, false
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(context.Canceled)
+	return err
+}
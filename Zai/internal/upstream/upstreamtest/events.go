@@ -0,0 +1,50 @@
+package upstreamtest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"Zai/internal/model"
+)
+
+// Data 把任意值编码为一行 "data: {...}"
+func Data(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return "data: " + string(b)
+}
+
+func completion(data map[string]any) string {
+	return Data(map[string]any{"type": "chat:completion", "data": data})
+}
+
+// Thinking thinking 阶段的增量内容，格式与上游一致（含 <details>/<summary> 等标签时原样传入）
+func Thinking(s string) string {
+	return completion(map[string]any{"phase": "thinking", "delta_content": s})
+}
+
+// Answer answer 阶段的增量内容
+func Answer(s string) string {
+	return completion(map[string]any{"phase": "answer", "delta_content": s})
+}
+
+// Done 结束信号，usage 为nil时不带用量
+func Done(usage *model.Usage) string {
+	data := map[string]any{"phase": "done", "done": true}
+	if usage != nil {
+		data["usage"] = usage
+	}
+	return completion(data)
+}
+
+// ErrorEvent 流中的上游错误事件（data.error）
+func ErrorEvent(code int, detail string) string {
+	return completion(map[string]any{"error": map[string]any{"code": code, "detail": detail}})
+}
+
+// Malformed 无法解析为JSON的数据行
+func Malformed(s string) string {
+	return fmt.Sprintf("data: {%s", s)
+}
@@ -0,0 +1,154 @@
+// Package upstreamtest 提供离线测试用的假上游：匿名token接口和按脚本回放的SSE对话接口
+package upstreamtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"Zai/internal/model"
+)
+
+// ChatPath 假上游的对话接口路径，与真实上游一致
+const ChatPath = "/api/chat/completions"
+
+// Script 一次对话请求的回放内容。Status 非0且不是200时直接返回该状态码和 Body；
+// 否则以SSE输出 Lines，每行后跟一个空行
+type Script struct {
+	Status int
+	Body   string
+	Lines  []string
+	Delay  time.Duration // 每行之间的等待时间
+}
+
+// Request 假上游收到的对话请求
+type Request struct {
+	Header http.Header
+	Body   model.UpstreamRequest
+}
+
+// Server 假上游。对话请求按 Enqueue 的顺序逐个消费脚本，脚本用完后的请求视为测试失败
+type Server struct {
+	*httptest.Server
+
+	// TokenStatus 匿名token接口的状态码，默认200
+	TokenStatus int
+	// TokenDelay 匿名token接口先返回响应头，等待该时长后再输出响应体
+	TokenDelay time.Duration
+
+	t        testing.TB
+	mu       sync.Mutex
+	scripts  []Script
+	requests []Request
+	tokens   int
+}
+
+// NewServer 启动假上游，测试结束时自动关闭
+func NewServer(t testing.TB) *Server {
+	s := &Server{t: t}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/auths/", s.handleAuth)
+	mux.HandleFunc("POST "+ChatPath, s.handleChat)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// ChatURL 对话接口地址，用作 upstream_url
+func (s *Server) ChatURL() string {
+	return s.URL + ChatPath
+}
+
+// Enqueue 追加后续对话请求的回放脚本
+func (s *Server) Enqueue(scripts ...Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts = append(s.scripts, scripts...)
+}
+
+// Requests 已收到的对话请求
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// TokenRequests 匿名token接口被调用的次数
+func (s *Server) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.tokens++
+	n := s.tokens
+	status, delay := s.TokenStatus, s.TokenDelay
+	s.mu.Unlock()
+
+	if status != 0 && status != http.StatusOK {
+		http.Error(w, `{"detail":"unavailable"}`, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if delay > 0 {
+		w.WriteHeader(http.StatusOK)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+	fmt.Fprintf(w, `{"token":"anon-token-%d"}`, n)
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	var body model.UpstreamRequest
+	raw, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(raw, &body); err != nil {
+		s.t.Errorf("upstreamtest: 请求体不是合法JSON: %v", err)
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Header: r.Header.Clone(), Body: body})
+	if len(s.scripts) == 0 {
+		s.mu.Unlock()
+		s.t.Errorf("upstreamtest: 第%d个对话请求没有对应的脚本", len(s.requests))
+		http.Error(w, "no script", http.StatusInternalServerError)
+		return
+	}
+	script := s.scripts[0]
+	s.scripts = s.scripts[1:]
+	s.mu.Unlock()
+
+	if script.Status != 0 && script.Status != http.StatusOK {
+		w.WriteHeader(script.Status)
+		io.WriteString(w, script.Body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	for i, line := range script.Lines {
+		if i > 0 && script.Delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(script.Delay):
+			}
+		}
+		fmt.Fprintf(w, "%s\n\n", line)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
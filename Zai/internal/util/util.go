@@ -1,21 +1,24 @@
 package util
 
 import (
-	"log"
 	"net/http"
-	"Zai/internal/config"
+	"strings"
 )
 
-// debug日志函数
-func DebugLog(format string, args ...interface{}) {
-	if config.DEBUG_MODE {
-		log.Printf("[DEBUG] "+format, args...)
-	}
-}
-
 func SetCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Api-Key, Anthropic-Version, X-Goog-Api-Key, X-Reasoning-Mode")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Upstream-Attempts, X-Request-ID")
+}
+
+// PartialSuffix 返回 s 末尾与 tag 前缀重合的最长长度，用于流式解析时保留可能被截断的标签
+func PartialSuffix(s, tag string) int {
+	for n := min(len(tag)-1, len(s)); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
 }
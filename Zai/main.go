@@ -1,21 +1,115 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"Zai/internal/auth"
 	"Zai/internal/config"
 	"Zai/internal/handler"
+	"Zai/internal/logging"
+	"Zai/internal/metrics"
 )
 
 func main() {
-	http.HandleFunc("/v1/models", handler.HandleModels)
-	http.HandleFunc("/v1/chat/completions", handler.HandleChatCompletions)
-	http.HandleFunc("/", handler.HandleOptions)
-
-	log.Printf("OpenAI兼容API服务器启动在端口%s", config.PORT)
-	log.Printf("模型: %s", config.MODEL_NAME)
-	log.Printf("上游: %s", config.UPSTREAM_URL)
-	log.Printf("Debug模式: %v", config.DEBUG_MODE)
-	log.Fatal(http.ListenAndServe(config.PORT, nil))
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "配置文件路径（JSON），也可通过 CONFIG_FILE 环境变量指定")
+	hashKey := flag.String("hash-key", "", "输出指定key的sha256哈希（用于配置 keys[].key_hash）后退出")
+	flag.Parse()
+
+	if *hashKey != "" {
+		fmt.Println(auth.HashKey(*hashKey))
+		return
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		slog.Error("加载配置失败", "error", err)
+		os.Exit(1)
+	}
+	logging.Setup(cfg)
+
+	h, err := handler.New(cfg)
+	if err != nil {
+		slog.Error("初始化失败", "error", err)
+		os.Exit(1)
+	}
+	http.HandleFunc("/v1/models", h.HandleModels)
+	http.HandleFunc("/v1/chat/completions", h.HandleChatCompletions)
+	http.HandleFunc("/v1/completions", h.HandleCompletions)
+	http.HandleFunc("/v1/messages", h.HandleAnthropicMessages)
+	http.HandleFunc("/v1/responses", h.HandleResponses)
+	http.HandleFunc("/v1/responses/", h.HandleResponses)
+	http.HandleFunc("/v1beta/models/", h.HandleGemini)
+	if cfg.Ollama.Enabled {
+		http.HandleFunc("/api/version", h.HandleOllamaVersion)
+		http.HandleFunc("/api/tags", h.HandleOllamaTags)
+		http.HandleFunc("/api/show", h.HandleOllamaShow)
+		http.HandleFunc("/api/chat", h.HandleOllamaChat)
+		http.HandleFunc("/api/generate", h.HandleOllamaGenerate)
+	}
+	http.HandleFunc("/healthz", h.HandleHealthz)
+	http.HandleFunc("/readyz", h.HandleReadyz)
+	if cfg.Metrics.Enabled {
+		http.HandleFunc("/metrics", h.HandleMetrics)
+	}
+	http.HandleFunc("/", h.HandleOptions)
+
+	slog.Info("OpenAI兼容API服务器启动", "port", cfg.Port, "default_model", cfg.ModelName, "models", len(cfg.Models), "upstream", cfg.UpstreamURL,
+		"debug", cfg.DebugMode, "log_level", cfg.Log.Level, "log_content", cfg.Log.Content, "metrics", cfg.Metrics.Enabled)
+	if cfg.Ollama.Enabled {
+		slog.Info("Ollama兼容接口已开启", "no_auth", cfg.Ollama.NoAuth)
+	}
+	serve(cfg, logging.Middleware(metrics.Middleware(http.DefaultServeMux)))
+}
+
+// serve 启动服务并在收到 SIGINT/SIGTERM 时优雅退出：停止接受新连接，
+// 等待进行中的请求（包括流式响应）最多 shutdown_timeout，超时后以 ErrShutdown 取消剩余请求，
+// 处理函数据此向客户端输出错误事件后结束
+func serve(cfg *config.Config, h http.Handler) {
+	baseCtx, cancelRequests := context.WithCancelCause(context.Background())
+	defer cancelRequests(nil)
+	srv := &http.Server{
+		Addr:              cfg.Port,
+		Handler:           h,
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
+		stop()
+		slog.Error("服务器退出", "error", err)
+		os.Exit(1)
+	case <-sigCtx.Done():
+	}
+	// 恢复默认信号处理，再次收到信号时立即退出
+	stop()
+
+	slog.Info("收到退出信号，等待进行中的请求完成", "timeout", cfg.ShutdownTimeout.Std())
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Std())
+	err := srv.Shutdown(drainCtx)
+	cancel()
+	if err != nil {
+		slog.Warn("等待超时，取消剩余请求", "error", err)
+		cancelRequests(handler.ErrShutdown)
+		// 留出时间让处理函数写完错误事件
+		finalCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := srv.Shutdown(finalCtx); err != nil {
+			srv.Close()
+		}
+		cancel()
+	}
+	slog.Info("服务器已退出")
 }